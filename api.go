@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/gob"
 	"os"
+	"sort"
+	"time"
 )
 
 // DefaultConfig is default config
@@ -11,7 +13,8 @@ var DefaultConfig = &Config{
 	FileMode:     0644,
 	DirMode:      0755,
 	SyncInterval: 0,
-	StoreMode:    0}
+	StoreMode:    0,
+	CommitWindow: 10}
 
 // Open return db object if it opened.
 // Create new db if not exist.
@@ -29,20 +32,67 @@ func Open(f string, cfg *Config) (*Db, error) {
 		return db, nil
 	}
 	dbs.RUnlock()
-	dbs.Lock()
-	db, err := newDb(f, cfg)
+	lockName(f)
+	// may be opened while lock released
+	db, ok = dbs.dbs[f]
+	if ok {
+		dbs.Unlock()
+		return db, nil
+	}
+	// reserve f, other files opened while f read,
+	// config copied under lock, DefaultConfig may be changed later
+	done := make(chan struct{})
+	dbs.opening[f] = done
+	c := *cfg
+	dbs.Unlock()
+	db, err := newDb(f, &c)
 	//log.Println("n", db.name, db.config.StoreMode)
+	dbs.Lock()
+	delete(dbs.opening, f)
 	if err == nil {
 		dbs.dbs[f] = db
 	}
+	close(done)
 	dbs.Unlock()
 	return db, err
 }
 
+// lockName lock dbs after running Open of file f finished
+func lockName(f string) {
+	dbs.Lock()
+	for {
+		done, ok := dbs.opening[f]
+		if !ok {
+			return
+		}
+		dbs.Unlock()
+		<-done
+		dbs.Lock()
+	}
+}
+
 // Set store any key value to db
 func (db *Db) Set(key, value interface{}) error {
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return err
+	}
+	v, err := ValToBinary(value)
+	if err != nil {
+		return err
+	}
 	db.Lock()
-	defer db.Unlock()
+	err = db.set(k, v, 0)
+	db.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.commit()
+}
+
+// SetWithTTL store key value to db, key expires after ttl
+// ttl rounded up to seconds, key with ttl <= 0 expired at once
+func (db *Db) SetWithTTL(key, value interface{}, ttl time.Duration) error {
 	k, err := KeyToBinary(key)
 	if err != nil {
 		return err
@@ -51,27 +101,41 @@ func (db *Db) Set(key, value interface{}) error {
 	if err != nil {
 		return err
 	}
-	//log.Println("Set:", k, v)
-	oldCmd, exists := db.vals[string(k)]
-	//fmt.Println("StoreMode", db.config.StoreMode)
-	if db.storemode == 2 {
-		cmd := &Cmd{}
-		cmd.Size = uint32(len(v))
-		cmd.Val = make([]byte, len(v))
-		copy(cmd.Val, v)
-		db.vals[string(k)] = cmd
-	} else {
-		cmd, err := writeKeyVal(db.fk, db.fv, k, v, exists, oldCmd)
-		if err != nil {
-			return err
-		}
-		db.vals[string(k)] = cmd
+	now := time.Now()
+	expire := uint32(now.Unix())
+	if ttl > 0 {
+		expire = uint32((now.Add(ttl).UnixNano() + int64(time.Second) - 1) / int64(time.Second))
 	}
-	if !exists {
-		db.appendKey(k)
+	db.Lock()
+	err = db.set(k, v, expire)
+	db.Unlock()
+	if err != nil {
+		return err
 	}
+	return db.commit()
+}
 
-	return err
+// TTL return time to live of key
+// Return 0 if key has no expiration time
+// Return ErrKeyNotFound if key not exists or expired
+func (db *Db) TTL(key interface{}) (time.Duration, error) {
+	db.RLock()
+	defer db.RUnlock()
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return 0, err
+	}
+	cmd, ok := db.index.get(k)
+	if !ok || isExpired(cmd) {
+		if err = db.indexErr(); err != nil {
+			return 0, err
+		}
+		return 0, ErrKeyNotFound
+	}
+	if cmd.Expire == 0 {
+		return 0, nil
+	}
+	return time.Until(time.Unix(int64(cmd.Expire), 0)), nil
 }
 
 // Get return value by key
@@ -83,39 +147,41 @@ func (db *Db) Get(key, value interface{}) error {
 	if err != nil {
 		return err
 	}
-	if val, ok := db.vals[string(k)]; ok {
-		switch value.(type) {
-		case *[]byte:
-			b := make([]byte, val.Size)
-			if db.storemode == 2 {
-				copy(b, val.Val)
-			} else {
-				_, err := db.fv.ReadAt(b, int64(val.Seek))
-				if err != nil {
-					return err
-				}
-			}
-			*value.(*[]byte) = b
-			return nil
-		default:
-
-			buf := new(bytes.Buffer)
-			b := make([]byte, val.Size)
-			if db.storemode == 2 {
-				//fmt.Println(val)
-				copy(b, val.Val)
-			} else {
-				_, err := db.fv.ReadAt(b, int64(val.Seek))
-				if err != nil {
-					return err
-				}
-			}
-			buf.Write(b)
-			err = gob.NewDecoder(buf).Decode(value)
-			return err
-		}
+	b, flags, err := db.get(k)
+	if err != nil {
+		return err
+	}
+	return decodeValue(b, flags, value)
+}
+
+// get return value of key and its flags, caller must hold lock
+func (db *Db) get(k []byte) ([]byte, uint8, error) {
+	if val, ok := db.index.get(k); ok && !isExpired(val) {
+		b, err := db.readValue(k, val)
+		return b, val.Flags, err
+	}
+	if err := db.indexErr(); err != nil {
+		return nil, 0, err
+	}
+	return nil, 0, ErrKeyNotFound
+}
+
+// decodeValue store value bytes to *[]byte, counters (value flags)
+// to number or decode them with gob
+func decodeValue(b []byte, flags uint8, value interface{}) error {
+	if ok, err := decodeCounter(b, flags, value); ok {
+		return err
+	}
+	switch value.(type) {
+	case *[]byte:
+		*value.(*[]byte) = b
+		return nil
+	default:
+
+		buf := new(bytes.Buffer)
+		buf.Write(b)
+		return gob.NewDecoder(buf).Decode(value)
 	}
-	return ErrKeyNotFound
 }
 
 // Close - sync & close files.
@@ -124,19 +190,26 @@ func (db *Db) Close() error {
 	if db.cancelSyncer != nil {
 		db.cancelSyncer()
 	}
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
 	db.Lock()
 	defer db.Unlock()
 
+	err := db.checkpoint()
+	if err != nil {
+		return err
+	}
 	if db.storemode == 2 && db.name != "" {
-		db.sort()
-		keys := make([][]byte, len(db.keys))
-
-		copy(keys, db.keys)
+		keys, _ := db.collectKeys(nil, 0, 0, true, nil)
 
 		db.storemode = 0
 		for _, k := range keys {
-			if val, ok := db.vals[string(k)]; ok {
-				writeKeyVal(db.fk, db.fv, k, val.Val, false, nil)
+			if val, ok := db.index.get(k); ok {
+				cmd := &Cmd{Expire: val.Expire, Flags: val.Flags, Version: val.Version}
+				sealed, err := db.sealKey(k, cmd)
+				if err == nil {
+					writeKeyVal(db.fk, db.fv, db.format, sealed, val.Val, cmd, -1, -1, false)
+				}
 			}
 		}
 	}
@@ -150,6 +223,8 @@ func (db *Db) Close() error {
 			return err
 		}
 	}
+	db.unmapValues()
+	db.closeSegments()
 	if db.fv != nil {
 		err := db.fv.Sync()
 		if err != nil {
@@ -161,6 +236,10 @@ func (db *Db) Close() error {
 			return err
 		}
 	}
+	if d := db.diskIndex(); d != nil {
+		d.close()
+	}
+	db.closed = true
 
 	dbs.Lock()
 	delete(dbs.dbs, db.name)
@@ -170,10 +249,7 @@ func (db *Db) Close() error {
 
 // CloseAll - close all opened Db
 func CloseAll() (err error) {
-	dbs.Lock()
-	stores := dbs.dbs
-	dbs.Unlock()
-	for _, db := range stores {
+	for _, db := range opened() {
 		err = db.Close()
 		if err != nil {
 			break
@@ -183,6 +259,17 @@ func CloseAll() (err error) {
 	return err
 }
 
+// opened return all opened Db
+func opened() []*Db {
+	dbs.RLock()
+	defer dbs.RUnlock()
+	stores := make([]*Db, 0, len(dbs.dbs))
+	for _, db := range dbs.dbs {
+		stores = append(stores, db)
+	}
+	return stores
+}
+
 // DeleteFile close and delete file
 func (db *Db) DeleteFile() error {
 	return DeleteFile(db.name)
@@ -193,7 +280,7 @@ func DeleteFile(file string) error {
 	if file == "" {
 		return nil
 	}
-	dbs.Lock()
+	lockName(file)
 	db, ok := dbs.dbs[file]
 	if ok {
 		dbs.Unlock()
@@ -210,6 +297,12 @@ func DeleteFile(file string) error {
 		return err
 	}
 	err = os.Remove(file + ".idx")
+	ids, _ := listSegments(file)
+	for _, id := range ids {
+		os.Remove(segmentName(file, id))
+	}
+	removeRuns(file)
+	os.Remove(file + checkpointSuffix)
 	return err
 }
 
@@ -222,8 +315,8 @@ func (db *Db) Has(key interface{}) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	_, has := db.vals[string(k)]
-	return has, nil
+	cmd, has := db.index.get(k)
+	return has && !isExpired(cmd), db.indexErr()
 }
 
 // FileSize returns the total size of the disk storage used by the DB.
@@ -235,6 +328,13 @@ func (db *Db) FileSize() (int64, error) {
 	if err != nil {
 		return -1, err
 	}
+	if db.segs != nil {
+		size := is.Size()
+		for _, s := range db.segs {
+			size += s.size
+		}
+		return size, nil
+	}
 	ds, err := db.fv.Stat()
 	if err != nil {
 		return -1, err
@@ -242,29 +342,75 @@ func (db *Db) FileSize() (int64, error) {
 	return is.Size() + ds.Size(), nil
 }
 
-// Count returns the number of items in the Db.
+// Discarded returns the number of bytes of incomplete index record,
+// truncated on open after crash, and of damaged records skipped with Recovery = 2.
+func (db *Db) Discarded() int64 {
+	db.RLock()
+	defer db.RUnlock()
+	return db.discarded
+}
+
+// Count returns the number of items in the Db, expired keys not counted.
 func (db *Db) Count() (int, error) {
 	db.RLock()
 	defer db.RUnlock()
-	return len(db.keys), nil
+	n := db.index.len()
+	if db.expiring > 0 {
+		// expired keys stay in index until swept
+		db.index.ascend(nil, func(k []byte, cmd *Cmd) bool {
+			if isExpired(cmd) {
+				n--
+			}
+			return true
+		})
+	}
+	return n, nil
 }
 
 // Delete remove key
 // Returns error if key not found
 func (db *Db) Delete(key interface{}) error {
-	db.Lock()
-	defer db.Unlock()
 	k, err := KeyToBinary(key)
 	if err != nil {
 		return err
 	}
-	if _, ok := db.vals[string(k)]; ok {
-		delete(db.vals, string(k))
-		db.deleteFromKeys(k)
-		writeKey(db.fk, 1, 0, 0, k, -1)
+	db.Lock()
+	err = db.delete(k)
+	db.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.commit()
+}
+
+// Sync commits the current contents of the db files to stable storage.
+func (db *Db) Sync() error {
+	db.RLock()
+	if db.fk == nil || db.closed {
+		db.RUnlock()
 		return nil
 	}
-	return ErrKeyNotFound
+	fv, pending, segmented := db.fv, len(db.pending), db.segs != nil
+	// values first, index records point to them
+	err := db.fv.Sync()
+	if err == nil {
+		err = db.fk.Sync()
+	}
+	db.RUnlock()
+	if err != nil || (pending == 0 && !segmented) {
+		return err
+	}
+	db.Lock()
+	defer db.Unlock()
+	if segmented && !db.closed {
+		// segments without live values may be removed
+		return db.removeDead()
+	}
+	if db.fv == fv {
+		// synced deletes, free space may be reused
+		db.releasePending(pending)
+	}
+	return nil
 }
 
 // KeysByPrefix return keys with prefix
@@ -276,107 +422,158 @@ func (db *Db) KeysByPrefix(prefix []byte, limit, offset int, asc bool) ([][]byte
 	//log.Println("KeysByPrefix")
 	db.RLock()
 	defer db.RUnlock()
+	return db.keys(prefix, true, limit, offset, asc)
+}
+
+// Keys return keys in ascending  or descending order (false - descending,true - ascending)
+// if limit == 0 return all keys
+// if offset > 0 - skip offset records
+// If from not nil - return keys after from (from not included)
+func (db *Db) Keys(from interface{}, limit, offset int, asc bool) ([][]byte, error) {
 	// resulting array
-	arr := make([][]byte, 0, 0)
-	found := db.foundPref(prefix, asc)
-	if found < 0 || found >= len(db.keys) || !startFrom(db.keys[found], prefix) {
-		//not found
-		return arr, ErrKeyNotFound
+	//log.Println("pudge", from, from == nil)
+	k, prefix, err := keysFrom(from)
+	if err != nil {
+		return make([][]byte, 0, 0), err
 	}
+	db.RLock()
+	defer db.RUnlock()
+	return db.keys(k, prefix, limit, offset, asc)
+}
 
-	start, end := checkInterval(found, limit, offset, 0, len(db.keys), asc)
-
-	if start < 0 || start >= len(db.keys) {
-		return arr, nil
+// keysFrom convert from of Keys to binary,
+// prefix is true for string or []byte ending with "*", "*" removed
+func keysFrom(from interface{}) (k []byte, prefix bool, err error) {
+	if from == nil {
+		return nil, false, nil
+	}
+	k, err = KeyToBinary(from)
+	//log.Println(bytes.Equal(k[len(k)-1:], []byte("*")))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(k) > 1 && bytes.Equal(k[len(k)-1:], []byte("*")) {
+		switch from.(type) {
+		case []byte, string:
+			prefix := make([]byte, len(k)-1)
+			copy(prefix, k)
+			return prefix, true, nil
+		}
 	}
+	return k, false, nil
+}
 
-	if asc {
-		for i := start; i <= end; i++ {
-			if !startFrom(db.keys[i], prefix) {
-				break
-			}
-			arr = append(arr, db.keys[i])
+// keys return keys with prefix or after from, caller must hold lock
+func (db *Db) keys(from []byte, prefix bool, limit, offset int, asc bool) ([][]byte, error) {
+	if prefix {
+		arr, found := db.collectKeys(prefixStart(from, asc), limit, offset, asc, func(k []byte) bool {
+			return startFrom(k, from)
+		})
+		if err := db.indexErr(); err != nil {
+			return nil, err
 		}
-	} else {
-		for i := start; i >= end; i-- {
-			if !startFrom(db.keys[i], prefix) {
-				break
+		if !found {
+			//not found
+			return arr, ErrKeyNotFound
+		}
+		return arr, nil
+	}
+	var start []byte
+	if from != nil {
+		if _, ok := db.index.get(from); !ok {
+			if err := db.indexErr(); err != nil {
+				return nil, err
 			}
-			arr = append(arr, db.keys[i])
+			return nil, ErrKeyNotFound
 		}
+		// descending walk start before key, ascending - after key
+		start = keysStart(from, asc)
 	}
-	return arr, nil
+	arr, _ := db.collectKeys(start, limit, offset, asc, nil)
+	return arr, db.indexErr()
 }
 
-// Keys return keys in ascending  or descending order (false - descending,true - ascending)
-// if limit == 0 return all keys
-// if offset > 0 - skip offset records
-// If from not nil - return keys after from (from not included)
-func (db *Db) Keys(from interface{}, limit, offset int, asc bool) ([][]byte, error) {
-	// resulting array
-	//log.Println("pudge", from, from == nil)
-	arr := make([][]byte, 0, 0)
-	excludeFrom := 0
-	if from != nil {
-		excludeFrom = 1
+// keysStart return key to start walk over keys after from (from not included)
+func keysStart(from []byte, asc bool) []byte {
+	if asc {
+		return append(append(make([]byte, 0, len(from)+1), from...), 0)
+	}
+	return from
+}
 
-		k, err := KeyToBinary(from)
-		//log.Println(bytes.Equal(k[len(k)-1:], []byte("*")))
-		if err != nil {
-			return arr, err
+// mergeKeys return keys like keys, keys in changed exist if changed[key]
+// regardless of index. Caller must hold lock
+func (db *Db) mergeKeys(from []byte, prefix bool, limit, offset int, asc bool, changed map[string]bool) ([][]byte, error) {
+	if len(changed) == 0 {
+		return db.keys(from, prefix, limit, offset, asc)
+	}
+	if from != nil && !prefix {
+		exists, ok := changed[string(from)]
+		if !ok {
+			_, exists = db.index.get(from)
 		}
-		if len(k) > 1 && bytes.Equal(k[len(k)-1:], []byte("*")) {
-			byteOrStr := false
-			switch from.(type) {
-			case []byte:
-				byteOrStr = true
-			case string:
-				byteOrStr = true
-			}
-			if byteOrStr {
-				prefix := make([]byte, len(k)-1)
-				copy(prefix, k)
-				return db.KeysByPrefix(prefix, limit, offset, asc)
+		if !exists {
+			if err := db.indexErr(); err != nil {
+				return nil, err
 			}
+			return nil, ErrKeyNotFound
 		}
 	}
-	db.RLock()
-	defer db.RUnlock()
-	find, err := db.findKey(from, asc)
-	if from != nil && err != nil {
+	// all keys of range merged with changed, then limit and offset applied
+	var start []byte
+	var match func([]byte) bool
+	switch {
+	case prefix:
+		start = prefixStart(from, asc)
+		match = func(k []byte) bool {
+			return startFrom(k, from)
+		}
+	case from != nil:
+		start = keysStart(from, asc)
+	}
+	stored, _ := db.collectKeys(start, 0, 0, asc, match)
+	if err := db.indexErr(); err != nil {
 		return nil, err
 	}
-	start, end := checkInterval(find, limit, offset, excludeFrom, len(db.keys), asc)
-	if start < 0 || start >= len(db.keys) {
-		return arr, nil
+	arr := make([][]byte, 0, len(stored))
+	for _, k := range stored {
+		if _, ok := changed[string(k)]; !ok {
+			arr = append(arr, k)
+		}
 	}
-
-	if asc {
-		for i := start; i <= end; i++ {
-			arr = append(arr, db.keys[i])
+	for key, exists := range changed {
+		if !exists {
+			continue
 		}
-	} else {
-		for i := start; i >= end; i-- {
-			arr = append(arr, db.keys[i])
+		k := []byte(key)
+		c := bytes.Compare(k, from)
+		switch {
+		case prefix:
+			if startFrom(k, from) {
+				arr = append(arr, k)
+			}
+		case from == nil, c > 0 && asc, c < 0 && !asc:
+			arr = append(arr, k)
 		}
 	}
-	return arr, nil
-}
-
-// Counter return int64 incremented on incr
-func (db *Db) Counter(key interface{}, incr int) (int64, error) {
-	mutex.Lock()
-	var counter int64
-	err := db.Get(key, &counter)
-	if err != nil && err != ErrKeyNotFound {
-		return -1, err
+	sort.Slice(arr, func(i, j int) bool {
+		if asc {
+			return bytes.Compare(arr[i], arr[j]) < 0
+		}
+		return bytes.Compare(arr[i], arr[j]) > 0
+	})
+	found := len(arr) > 0
+	if offset > len(arr) {
+		offset = len(arr)
 	}
-	//mutex.Lock()
-	counter = counter + int64(incr)
-	//mutex.Unlock()
-	err = db.Set(key, counter)
-	mutex.Unlock()
-	return counter, err
+	arr = arr[offset:]
+	if limit > 0 && limit < len(arr) {
+		arr = arr[:limit]
+	}
+	if prefix && !found {
+		return arr, ErrKeyNotFound
+	}
+	return arr, nil
 }
 
 // Set store any key value to db with opening if needed
@@ -391,24 +588,26 @@ func Set(f string, key, value interface{}) error {
 // Sets store vals and keys
 // Use it for mass insertion
 // every pair must contain key and value
+// pairs written in one batch, all or nothing
 func Sets(file string, pairs []interface{}) (err error) {
 	db, err := Open(file, nil)
 	if err != nil {
 		return err
 	}
+	var b Batch
 	for i := range pairs {
 		if i%2 != 0 {
 			// on odd - append val and store key
 			if pairs[i] == nil || pairs[i-1] == nil {
 				break
 			}
-			err = db.Set(pairs[i-1], pairs[i])
+			err = b.Set(pairs[i-1], pairs[i])
 			if err != nil {
-				break
+				return err
 			}
 		}
 	}
-	return err
+	return db.Write(&b)
 }
 
 // Get return value by key with opening if needed
@@ -510,27 +709,35 @@ func Close(f string) error {
 // BackupAll - backup all opened Db
 // if dir not set it will be backup
 // delete old backup file before run
+// backup encrypted, compressed and indexed like its Db (same key, Codec and IndexMode)
 // ignore all errors
 func BackupAll(dir string) (err error) {
 	if dir == "" {
 		dir = "backup"
 	}
-	dbs.Lock()
-	stores := dbs.dbs
-	dbs.Unlock()
 	//tmp := make(map[string]string)
-	for _, db := range stores {
+	for _, db := range opened() {
 		backup := dir + "/" + db.name
 		DeleteFile(backup)
+		cfg := *DefaultConfig
+		cfg.Codec = db.config.Codec
+		cfg.EncryptionKey = db.config.EncryptionKey
+		cfg.KeyProvider = db.config.KeyProvider
+		cfg.EncryptKeys = db.config.EncryptKeys
+		cfg.IndexMode = db.config.IndexMode
+		b, err := Open(backup, &cfg)
+		if err != nil {
+			continue
+		}
 		keys, err := db.Keys(nil, 0, 0, true)
 		if err == nil {
 			for _, k := range keys {
-				var b []byte
-				db.Get(k, &b)
-				Set(backup, k, b)
+				var v []byte
+				db.Get(k, &v)
+				b.Set(k, v)
 			}
 		}
-		Close(backup)
+		b.Close()
 	}
 
 	return err
@@ -0,0 +1,222 @@
+package pudge
+
+// Batch - set and delete operations, applied by Db.Write all or nothing
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key []byte
+	val []byte
+	del bool
+}
+
+// Set add set of key value to batch
+// Return error if key or value can't be converted
+func (b *Batch) Set(key, value interface{}) error {
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return err
+	}
+	v, err := ValToBinary(value)
+	if err != nil {
+		return err
+	}
+	b.ops = append(b.ops, batchOp{key: k, val: v})
+	return nil
+}
+
+// Delete add delete of key to batch, missing keys ignored by Write
+// Return error if key can't be converted
+func (b *Batch) Delete(key interface{}) error {
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return err
+	}
+	b.ops = append(b.ops, batchOp{key: k, del: true})
+	return nil
+}
+
+// Len return number of operations in batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset remove all operations, so batch may be reused
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write apply operations of batch in order under one lock.
+// Records of batch written to index between begin and commit markers,
+// Open apply them only if commit marker written, so after crash
+// all or none operations of batch are visible.
+// Return error if any, on error no operations applied
+func (db *Db) Write(b *Batch) error {
+	if b == nil || len(b.ops) == 0 {
+		return nil
+	}
+	db.Lock()
+	err := db.write(b.ops)
+	db.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.commit()
+}
+
+// batchRec - record of batch read from index, not applied until commit
+type batchRec struct {
+	t   uint8
+	key []byte
+	cmd *Cmd
+}
+
+// batchUndo - record of key before batch
+type batchUndo struct {
+	key    []byte
+	cmd    *Cmd
+	exists bool
+}
+
+// batchSpace - space accounting before batch, restored by rollback
+type batchSpace struct {
+	used, garbage int64
+	size          int64 // size of values
+	holes         []hole
+	live          map[uint32]int64 // live bytes of segments
+}
+
+// write apply operations, caller must hold lock
+func (db *Db) write(ops []batchOp) error {
+	for _, op := range ops {
+		if size := db.keySize(op.key); size > maxKeySize(db.format) {
+			return &ErrKeyTooLong{Size: size, Max: maxKeySize(db.format)}
+		}
+	}
+	if err := db.indexErr(); err != nil {
+		return err
+	}
+	if db.storemode == 2 {
+		// index written on Close
+		for _, op := range ops {
+			var err error
+			if op.del {
+				err = db.delete(op.key)
+			} else {
+				err = db.set(op.key, op.val, 0)
+			}
+			if err != nil && err != ErrKeyNotFound {
+				return err
+			}
+		}
+		return nil
+	}
+	begin, err := writeKey(db.fk, db.format, recBegin, &Cmd{Size: uint64(len(ops))}, nil, -1)
+	if err != nil {
+		return err
+	}
+	undo := make([]batchUndo, 0, len(ops))
+	space := db.saveSpace()
+	// freed space reused only after commit, old records stay valid until it
+	db.batching = true
+	for _, op := range ops {
+		cmd, exists := db.index.get(op.key)
+		if exists {
+			c := *cmd
+			cmd = &c
+		}
+		undo = append(undo, batchUndo{key: op.key, cmd: cmd, exists: exists})
+		if op.del {
+			err = db.delete(op.key)
+			if err == ErrKeyNotFound {
+				err = nil
+			}
+		} else {
+			err = db.set(op.key, op.val, 0)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = writeKey(db.fk, db.format, recCommit, &Cmd{Size: uint64(len(ops))}, nil, -1)
+	}
+	db.batching = false
+	deferred := db.deferred
+	db.deferred = nil
+	if err != nil {
+		db.rollback(undo, space, begin)
+		return err
+	}
+	// begin and commit records are garbage
+	markers := 2 * db.keyRecordSize(nil)
+	db.used += markers
+	db.garbage += markers
+	for _, h := range deferred {
+		db.freeHole(h.seek, h.size)
+	}
+	return db.flushIndex()
+}
+
+// saveSpace return space accounting for rollback
+func (db *Db) saveSpace() batchSpace {
+	s := batchSpace{used: db.used, garbage: db.garbage, size: db.valuesSize()}
+	s.holes = append([]hole(nil), db.holes...)
+	if db.segs != nil {
+		s.live = make(map[uint32]int64, len(db.segs))
+		for id, seg := range db.segs {
+			s.live[id] = seg.live
+		}
+	}
+	return s
+}
+
+// valuesSize return size of value file or segments
+func (db *Db) valuesSize() (size int64) {
+	if db.segs != nil {
+		for _, s := range db.segs {
+			size += s.size
+		}
+		return size
+	}
+	if stat, err := db.fv.Stat(); err == nil {
+		size = stat.Size()
+	}
+	return size
+}
+
+// rollback restore index and space accounting after failed batch
+// and cut batch records from index file, values written by batch are garbage
+func (db *Db) rollback(undo []batchUndo, space batchSpace, begin int64) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		u := undo[i]
+		if db.cache != nil {
+			db.cache.remove(u.key)
+		}
+		cur, ok := db.index.get(u.key)
+		if ok && cur.Expire != 0 {
+			db.expiring--
+		}
+		if u.exists {
+			db.index.put(u.key, u.cmd)
+			if u.cmd.Expire != 0 {
+				db.expiring++
+			}
+		} else {
+			db.index.remove(u.key)
+		}
+	}
+	grown := db.valuesSize() - space.size
+	if err := db.fk.Truncate(begin); err != nil {
+		// batch records stay in index as garbage
+		if stat, err := db.fk.Stat(); err == nil {
+			grown += stat.Size() - begin
+		}
+	}
+	db.used, db.garbage = space.used+grown, space.garbage+grown
+	db.holes = space.holes
+	for id, s := range db.segs {
+		s.live = space.live[id]
+	}
+}
@@ -0,0 +1,114 @@
+package pudge
+
+import (
+	"encoding/binary"
+	"math"
+	"sync/atomic"
+)
+
+// BloomStats - counters of lookups in runs of disk index with bloom filters
+type BloomStats struct {
+	Lookups        int64 // lookups of keys not found in memtable
+	Negatives      int64 // lookups answered by filters without read of runs
+	FalsePositives int64 // runs read for missing keys passed by filter
+}
+
+// BloomStats return counters of bloom filters, zero if filters not used
+func (db *Db) BloomStats() BloomStats {
+	db.RLock()
+	defer db.RUnlock()
+	d := db.diskIndex()
+	if d == nil {
+		return BloomStats{}
+	}
+	return BloomStats{
+		Lookups:        atomic.LoadInt64(&d.stats.Lookups),
+		Negatives:      atomic.LoadInt64(&d.stats.Negatives),
+		FalsePositives: atomic.LoadInt64(&d.stats.FalsePositives),
+	}
+}
+
+// bloom - bloom filter of keys of run, k bits of m set for every key
+type bloom struct {
+	k    uint32
+	bits []uint64
+}
+
+// newBloom return filter for n keys with false positive rate fp
+func newBloom(n int64, fp float64) *bloom {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(fp) / (math.Ln2 * math.Ln2))
+	if m < 64 {
+		m = 64
+	}
+	k := uint32(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	return &bloom{k: k, bits: make([]uint64, (uint64(m)+63)/64)}
+}
+
+// bloomHash return 64 bit hash of key: fnv-1a with final mix
+func bloomHash(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
+}
+
+// bit positions derived from two halves of hash (double hashing)
+func (b *bloom) add(h uint64) {
+	m := uint64(len(b.bits)) * 64
+	h1, h2 := h&math.MaxUint32, h>>32|1
+	for i := uint64(0); i < uint64(b.k); i++ {
+		pos := (h1 + i*h2) % m
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+// has return false if key with hash h never added
+func (b *bloom) has(h uint64) bool {
+	m := uint64(len(b.bits)) * 64
+	h1, h2 := h&math.MaxUint32, h>>32|1
+	for i := uint64(0); i < uint64(b.k); i++ {
+		pos := (h1 + i*h2) % m
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// append filter: k 4, bits 8 each
+func (b *bloom) append(dst []byte) []byte {
+	dst = appendUint32(dst, b.k)
+	for _, w := range b.bits {
+		dst = appendUint64(dst, w)
+	}
+	return dst
+}
+
+// decodeBloom return filter from bytes, nil if b is not filter
+func decodeBloom(b []byte) *bloom {
+	if len(b) < 12 || (len(b)-4)%8 != 0 {
+		return nil
+	}
+	f := &bloom{k: binary.BigEndian.Uint32(b), bits: make([]uint64, (len(b)-4)/8)}
+	if f.k < 1 || f.k > 30 {
+		return nil
+	}
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(b[4+i*8:])
+	}
+	return f
+}
@@ -0,0 +1,102 @@
+package pudge
+
+import (
+	"container/list"
+	"sync"
+)
+
+const cacheEntry = 64 // approximate memory of cache entry without key and value
+
+// CacheStats - counters of value cache
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	Size   int64 // bytes used by cached keys and values
+	Items  int
+}
+
+// valueCache - LRU cache of decoded values, limited by size in bytes
+// has own lock, readers of Db share read lock
+type valueCache struct {
+	mu     sync.Mutex
+	limit  int64
+	size   int64
+	lru    *list.List // front - recently used
+	items  map[string]*list.Element
+	hits   int64
+	misses int64
+}
+
+type cacheItem struct {
+	key string
+	val []byte
+}
+
+func newValueCache(limit int64) *valueCache {
+	return &valueCache{limit: limit, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (it *cacheItem) cost() int64 {
+	return int64(len(it.key) + len(it.val) + cacheEntry)
+}
+
+// get return copy of cached value
+func (c *valueCache) get(k []byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[string(k)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return append([]byte(nil), e.Value.(*cacheItem).val...), true
+}
+
+// add copy value to cache and evict least recently used values
+func (c *valueCache) add(k, v []byte) {
+	it := &cacheItem{key: string(k), val: append([]byte(nil), v...)}
+	if it.cost() > c.limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drop(it.key)
+	c.items[it.key] = c.lru.PushFront(it)
+	c.size += it.cost()
+	for c.size > c.limit {
+		c.drop(c.lru.Back().Value.(*cacheItem).key)
+	}
+}
+
+// remove invalidate value of key
+func (c *valueCache) remove(k []byte) {
+	c.mu.Lock()
+	c.drop(string(k))
+	c.mu.Unlock()
+}
+
+func (c *valueCache) drop(k string) {
+	if e, ok := c.items[k]; ok {
+		c.size -= e.Value.(*cacheItem).cost()
+		c.lru.Remove(e)
+		delete(c.items, k)
+	}
+}
+
+func (c *valueCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Size: c.size, Items: len(c.items)}
+}
+
+// CacheStats return counters of value cache, zero if Config.CacheSize not set
+func (db *Db) CacheStats() CacheStats {
+	db.RLock()
+	defer db.RUnlock()
+	if db.cache == nil {
+		return CacheStats{}
+	}
+	return db.cache.stats()
+}
@@ -0,0 +1,148 @@
+package pudge
+
+import "bytes"
+
+// CompareAndSwap store new value of key if current value is equal to old,
+// values compared in binary form (see ValToBinary).
+// Return true if value swapped, ErrKeyNotFound if key not exists, or error if any.
+func (db *Db) CompareAndSwap(key, old, new interface{}) (bool, error) {
+	o, err := ValToBinary(old)
+	if err != nil {
+		return false, err
+	}
+	return db.setIf(key, new, false, db.equals(o))
+}
+
+// SetIfNotExists store key value if key not exists.
+// Return true if value stored, or error if any.
+func (db *Db) SetIfNotExists(key, value interface{}) (bool, error) {
+	return db.setIf(key, value, false, func(k []byte, cmd *Cmd) (bool, error) {
+		return cmd == nil, nil
+	})
+}
+
+// DeleteIfEquals remove key if current value is equal to value.
+// Return true if key removed, ErrKeyNotFound if key not exists, or error if any.
+func (db *Db) DeleteIfEquals(key, value interface{}) (bool, error) {
+	v, err := ValToBinary(value)
+	if err != nil {
+		return false, err
+	}
+	return db.setIf(key, nil, true, db.equals(v))
+}
+
+// SetIfVersion store key value if current version of key is equal to version,
+// version 0 - key not exists (or stored before format v6).
+// Version of key incremented by every set, new key or key created again after
+// delete get version greater than all versions given before.
+// Return true if value stored, ErrFormat for legacy index format, or error if any.
+func (db *Db) SetIfVersion(key, value interface{}, version uint64) (bool, error) {
+	return db.setIf(key, value, false, func(k []byte, cmd *Cmd) (bool, error) {
+		if db.format < formatV6 {
+			return false, ErrFormat
+		}
+		if cmd == nil {
+			return version == 0, nil
+		}
+		return cmd.Version == version, nil
+	})
+}
+
+// Version return version of key
+// Return ErrKeyNotFound if key not exists, ErrFormat for legacy index format
+func (db *Db) Version(key interface{}) (uint64, error) {
+	return db.GetWithVersion(key, nil)
+}
+
+// GetWithVersion return version of key and store its value in value (if not nil),
+// value and version read atomically, see SetIfVersion
+// Return ErrKeyNotFound if key not exists, ErrFormat for legacy index format
+func (db *Db) GetWithVersion(key, value interface{}) (uint64, error) {
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return 0, err
+	}
+	db.RLock()
+	defer db.RUnlock()
+	if db.format < formatV6 {
+		return 0, ErrFormat
+	}
+	cmd, err := db.current(k)
+	if err != nil {
+		return 0, err
+	}
+	if cmd == nil {
+		return 0, ErrKeyNotFound
+	}
+	if value != nil {
+		b, err := db.readValue(k, cmd)
+		if err != nil {
+			return 0, err
+		}
+		err = decodeValue(b, cmd.Flags, value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return cmd.Version, nil
+}
+
+// current return record of key, nil if key not exists or expired. Caller must hold lock
+func (db *Db) current(k []byte) (*Cmd, error) {
+	cmd, ok := db.index.get(k)
+	if err := db.indexErr(); err != nil {
+		return nil, err
+	}
+	if !ok || isExpired(cmd) {
+		return nil, nil
+	}
+	return cmd, nil
+}
+
+// equals return check of setIf: current value of key is equal to v
+func (db *Db) equals(v []byte) func(k []byte, cmd *Cmd) (bool, error) {
+	return func(k []byte, cmd *Cmd) (bool, error) {
+		if cmd == nil {
+			return false, ErrKeyNotFound
+		}
+		b, err := db.readValue(k, cmd)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(b, v), nil
+	}
+}
+
+// setIf store value (or delete key if del) under lock if check of current
+// record of key return true, record is nil if key not exists
+func (db *Db) setIf(key, value interface{}, del bool, check func(k []byte, cmd *Cmd) (bool, error)) (bool, error) {
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return false, err
+	}
+	var v []byte
+	if !del {
+		v, err = ValToBinary(value)
+		if err != nil {
+			return false, err
+		}
+	}
+	db.Lock()
+	cmd, err := db.current(k)
+	ok := false
+	if err == nil {
+		ok, err = check(k, cmd)
+	}
+	if ok && err == nil {
+		if del {
+			err = db.delete(k)
+		} else {
+			err = db.set(k, v, 0)
+		}
+	}
+	db.Unlock()
+	if !ok || err != nil {
+		return false, err
+	}
+	return true, db.commit()
+}
@@ -0,0 +1,135 @@
+package pudge
+
+import "os"
+
+const checkpointSuffix = ".ckp" // live index records at watermark of index log
+
+// Checkpoint write live index records to checkpoint file, so Open load
+// checkpoint and replay only index records written after it.
+// In IndexDisk mode memtable written to run file.
+// Checkpoint do nothing if Config.Checkpoint not set or in memory first mode.
+// Return error if any.
+func (db *Db) Checkpoint() error {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	if db.diskIndex() != nil {
+		db.Lock()
+		defer db.Unlock()
+	} else {
+		db.RLock()
+		defer db.RUnlock()
+	}
+	return db.checkpoint()
+}
+
+// checkpoint caller must hold compactMu and lock (write lock for disk index)
+func (db *Db) checkpoint() error {
+	if db.closed || !db.config.Checkpoint || db.config.StoreMode == 2 || db.fk == nil {
+		return nil
+	}
+	d := db.diskIndex()
+	if d != nil && d.mem.len() == 0 {
+		return nil
+	}
+	state, err := db.logState()
+	if err != nil {
+		return err
+	}
+	if d != nil {
+		return d.flush(state)
+	}
+	state.count = int64(db.index.len())
+	var sealErr error
+	r, err := writeRunFile(db.name+checkpointSuffix, os.FileMode(db.config.FileMode), 0, 0, &state, 0, 0, false,
+		func(fn func(k []byte, cmd *Cmd) bool) {
+			db.index.ascend(nil, func(k []byte, cmd *Cmd) bool {
+				// keys encrypted like keys of index log
+				c := *cmd
+				sealed, err := db.sealKey(k, &c)
+				if err != nil {
+					sealErr = err
+					return false
+				}
+				return fn(sealed, &c)
+			})
+		})
+	if err != nil {
+		return err
+	}
+	err = r.f.Close()
+	if sealErr != nil {
+		os.Remove(r.file)
+		return sealErr
+	}
+	return err
+}
+
+// logState sync files and return state of index log for runs and checkpoint
+func (db *Db) logState() (state runState, err error) {
+	err = db.fv.Sync()
+	if err == nil {
+		err = db.fk.Sync()
+	}
+	var stat os.FileInfo
+	if err == nil {
+		stat, err = db.fk.Stat()
+	}
+	if err == nil {
+		state.watermark = stat.Size()
+		state.print, err = logPrint(db.fk, state.watermark)
+	}
+	state.live = db.used - db.garbage
+	state.expiring = int64(db.expiring)
+	state.version = db.version
+	return state, err
+}
+
+// matchLog return true if index log is not rewritten since state
+func matchLog(fk *os.File, state runState) bool {
+	stat, err := fk.Stat()
+	if err != nil || stat.Size() < state.watermark {
+		return false
+	}
+	fp, err := logPrint(fk, state.watermark)
+	return err == nil && fp == state.print
+}
+
+// loadCheckpoint fill index from checkpoint and return state for replay of log tail
+// stale or damaged checkpoint removed, index log replayed from start
+func (db *Db) loadCheckpoint() runState {
+	file := db.name + checkpointSuffix
+	os.Remove(file + ".tmp")
+	r, err := openRun(file, 0, 0)
+	if err != nil {
+		os.Remove(file)
+		return runState{}
+	}
+	defer r.f.Close()
+	if !matchLog(db.fk, r.state) {
+		os.Remove(file)
+		return runState{}
+	}
+	c := r.cursor(nil, true)
+	for ; c.valid(); c.next() {
+		key, cmd := c.recs[c.i].key, c.recs[c.i].cmd
+		if cmd.Flags&flagKeyEncrypted != 0 {
+			key, err = db.open(key, nil)
+			if err != nil {
+				break
+			}
+		}
+		db.index.put(key, &cmd)
+	}
+	if c.err != nil || err != nil {
+		db.index = newIndex(db.config.IndexMode, db.storemode)
+		os.Remove(file)
+		return runState{}
+	}
+	return r.state
+}
+
+// appendIndex return true if index records never rewritten in place,
+// so records after watermark of runs and checkpoint are the only changes
+func (db *Db) appendIndex() bool {
+	return db.config.Checkpoint || db.diskIndex() != nil
+}
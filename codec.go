@@ -0,0 +1,102 @@
+package pudge
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io/ioutil"
+)
+
+// ErrNoCodec - value compressed, but Config.Codec not set
+var ErrNoCodec = errors.New("Error: value is compressed, Config.Codec required")
+
+// Codec compress and decompress values, see Config.Codec
+type Codec interface {
+	Encode(b []byte) ([]byte, error)
+	Decode(b []byte) ([]byte, error)
+}
+
+// FlateCodec compress values with compress/flate
+// Level 0 - flate.DefaultCompression
+type FlateCodec struct {
+	Level int
+}
+
+// Encode return compressed b
+func (c FlateCodec) Encode(b []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	return buf.Bytes(), err
+}
+
+// Decode return decompressed b
+func (c FlateCodec) Decode(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// encodeVal compress value with Config.Codec if it makes value smaller,
+// encrypt value bound to key k if encryption key set and return value with its flags
+func (db *Db) encodeVal(k, v []byte) ([]byte, uint8, error) {
+	var flags uint8
+	if db.format < formatV4 {
+		if db.aead != nil {
+			return nil, 0, ErrFormat
+		}
+		return v, 0, nil
+	}
+	if db.config.Codec != nil {
+		c, err := db.config.Codec.Encode(v)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(c) < len(v) {
+			v = c
+			flags |= flagCompressed
+		}
+	}
+	if db.aead != nil {
+		// value can't be moved to other key
+		c, err := db.seal(v, k)
+		if err != nil {
+			return nil, 0, err
+		}
+		v = c
+		flags |= flagEncrypted | flagKeyAD
+	}
+	return v, flags, nil
+}
+
+// decodeVal return original value of key k
+func (db *Db) decodeVal(k, v []byte, flags uint8) (_ []byte, err error) {
+	if flags&flagEncrypted != 0 {
+		var ad []byte
+		if flags&flagKeyAD != 0 {
+			ad = k
+		}
+		v, err = db.open(v, ad)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if flags&flagCompressed == 0 {
+		return v, nil
+	}
+	if db.config.Codec == nil {
+		return nil, ErrNoCodec
+	}
+	return db.config.Codec.Decode(v)
+}
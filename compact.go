@@ -0,0 +1,335 @@
+package pudge
+
+import (
+	"hash/crc32"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	compactSuffix = ".compact"   // temporary files of running compaction
+	compactDone   = ".compacted" // index of finished compaction, ready for swap
+)
+
+// Compact rewrites live keys and values into fresh files and swaps them
+// with current files. Readers are not blocked while live records copied,
+// writers are tracked and replayed on new files before swap.
+// Compact upgrades legacy files to current index format.
+// With segmented value log (Config.SegmentSize) live values of sealed segments
+// with garbage ratio over Config.CompactRatio moved to active segment and
+// segments removed, then only index file rewritten.
+// Compact do nothing in memory first mode (StoreMode 2).
+// With IndexDisk records of runs streamed to new files and new run.
+// Return ErrSnapshotOpen if snapshots open, or error if any.
+func (db *Db) Compact() error {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	db.RLock()
+	segmented, snapshots := db.segs != nil, len(db.snaps) > 0
+	db.RUnlock()
+	if snapshots {
+		// old values of snapshots must stay in place
+		return ErrSnapshotOpen
+	}
+	if segmented {
+		err := db.compactSegments()
+		if err != nil {
+			return err
+		}
+	}
+
+	// snapshot live keys
+	db.Lock()
+	if db.closed || db.storemode == 2 || db.fv == nil {
+		db.Unlock()
+		return nil
+	}
+	if d := db.diskIndex(); d != nil {
+		return db.compactDisk(d, segmented)
+	}
+	src := db.fv
+	keys := make([][]byte, 0, db.index.len())
+	cmds := make([]Cmd, 0, db.index.len())
+	db.index.ascend(nil, func(k []byte, cmd *Cmd) bool {
+		keys = append(keys, k)
+		cmds = append(cmds, *cmd)
+		return true
+	})
+	db.dirty = make(map[string]struct{})
+	db.Unlock()
+
+	fv, fk, err := createCompactFiles(db.name, os.FileMode(db.config.FileMode), !segmented)
+	var newVals map[string]*Cmd
+	if err == nil {
+		// copy values, readers and writers use old files
+		newVals, err = db.copyLive(src, fv, fk, db.format, keys, cmds)
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	if err == nil {
+		err = db.replayDirty(fv, fk, newVals)
+	}
+	if err == nil {
+		err = swapCompactFiles(db.name, fv, fk)
+	}
+	db.dirty = nil
+	if err != nil {
+		removeCompactFiles(db.name, fv, fk)
+		return err
+	}
+	db.useCompactFiles(fv, fk)
+	for k, cmd := range newVals {
+		db.index.put([]byte(k), cmd)
+		db.used += int64(cmd.Size) + db.keyRecordSize([]byte(k))
+	}
+	return nil
+}
+
+// useCompactFiles replace current files with swapped files of compaction,
+// used computed by caller. Caller must hold lock
+func (db *Db) useCompactFiles(fv, fk *os.File) {
+	if fv != nil {
+		db.unmapValues()
+		db.fv.Close()
+		db.fv = fv
+	}
+	db.fk.Close()
+	db.fk = fk
+	db.format = currentFormat
+	db.holes, db.pending = nil, nil
+	db.used, db.garbage = 0, 0
+	for _, s := range db.segs {
+		// dead values of active and sealed segments
+		db.used += s.size - s.live
+		db.garbage += s.size - s.live
+	}
+	if stat, err := db.fv.Stat(); err == nil {
+		db.mapValues(stat.Size())
+	}
+}
+
+// copyLive copy values of keys from src to new files
+func (db *Db) copyLive(src, fv, fk *os.File, format uint8, keys [][]byte, cmds []Cmd) (map[string]*Cmd, error) {
+	newVals := make(map[string]*Cmd, len(keys))
+	for i, k := range keys {
+		cmd, err := db.copyKey(src, fv, fk, format, k, &cmds[i])
+		if err != nil {
+			return nil, err
+		}
+		newVals[string(k)] = cmd
+	}
+	return newVals, nil
+}
+
+// copyKey copy value of key k from src to new files and return its new record,
+// without fv (segments) only index record written
+func (db *Db) copyKey(src, fv, fk *os.File, format uint8, k []byte, old *Cmd) (*Cmd, error) {
+	if fv == nil {
+		var val []byte
+		var err error
+		if format < formatV2 {
+			// checksum of value added on upgrade
+			db.RLock()
+			val, err = db.readStored(k, old)
+			db.RUnlock()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return db.copyRecord(fk, k, old, val, -1)
+	}
+	val, err := readVal(src, format, old, k)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &Cmd{Expire: old.Expire, Flags: old.Flags, Version: old.Version}
+	sealed, err := db.sealKey(k, cmd)
+	if err == nil {
+		err = writeKeyVal(fk, fv, currentFormat, sealed, val, cmd, -1, -1, false)
+	}
+	return cmd, err
+}
+
+// replayDirty write to new files current state of keys, changed during copy,
+// and highest version given to keys
+func (db *Db) replayDirty(fv, fk *os.File, newVals map[string]*Cmd) (err error) {
+	for k := range db.dirty {
+		key := []byte(k)
+		newCmd, exists := newVals[k]
+		cmd, ok := db.index.get(key)
+		if !ok {
+			if exists {
+				delete(newVals, k)
+				tomb := &Cmd{Version: db.version}
+				var sealed []byte
+				sealed, err = db.sealKey(key, tomb)
+				if err == nil {
+					_, err = writeKey(fk, currentFormat, 1, tomb, sealed, -1)
+				}
+			}
+		} else {
+			keySeek := int64(-1)
+			if exists && !db.appendIndex() {
+				keySeek = int64(newCmd.KeySeek)
+			}
+			if fv == nil {
+				var val []byte
+				if db.format < formatV2 {
+					val, err = db.readStored(key, cmd)
+				}
+				if err == nil {
+					newVals[k], err = db.copyRecord(fk, key, cmd, val, keySeek)
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			var val []byte
+			val, err = readVal(db.fv, db.format, cmd, key)
+			if err == nil {
+				newCmd = &Cmd{Expire: cmd.Expire, Flags: cmd.Flags, Version: cmd.Version}
+				var sealed []byte
+				sealed, err = db.sealKey(key, newCmd)
+				if err == nil {
+					err = writeKeyVal(fk, fv, currentFormat, sealed, val, newCmd, -1, keySeek, false)
+				}
+				newVals[k] = newCmd
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// commit without batch keep highest version, versions of deleted keys not copied
+	_, err = writeKey(fk, currentFormat, recCommit, &Cmd{Version: db.version}, nil, -1)
+	return err
+}
+
+// copyRecord write index record of key to new index file, value not moved,
+// checksum computed if stored value val passed
+func (db *Db) copyRecord(fk *os.File, k []byte, old *Cmd, val []byte, keySeek int64) (*Cmd, error) {
+	cmd := &Cmd{Seek: old.Seek, Size: old.Size, Checksum: old.Checksum, Expire: old.Expire, Flags: old.Flags, Version: old.Version}
+	if val != nil {
+		cmd.Checksum = crc32.Checksum(val, crcTable)
+	}
+	sealed, err := db.sealKey(k, cmd)
+	if err != nil {
+		return nil, err
+	}
+	keySeek, err = writeKey(fk, currentFormat, 0, cmd, sealed, keySeek)
+	cmd.KeySeek = uint64(keySeek)
+	return cmd, err
+}
+
+// maybeCompact starts background compaction if garbage ratio
+// exceeds Config.CompactRatio
+func (db *Db) maybeCompact() {
+	if db.config.CompactRatio <= 0 || db.used == 0 || db.dirty != nil {
+		return
+	}
+	if float64(db.garbage)/float64(db.used) < db.config.CompactRatio {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&db.compactRun, 0, 1) {
+		return
+	}
+	go func() {
+		err := db.Compact()
+		db.Lock()
+		db.compactErr = err
+		db.Unlock()
+		atomic.StoreInt32(&db.compactRun, 0)
+	}()
+}
+
+// CompactErr returns the error of last background compaction (Config.CompactRatio),
+// nil if it succeeded or not run
+func (db *Db) CompactErr() error {
+	db.RLock()
+	defer db.RUnlock()
+	return db.compactErr
+}
+
+// fileName return name of file, files of compaction keep
+// temporary name after swap
+func fileName(f *os.File) string {
+	return strings.TrimSuffix(f.Name(), compactSuffix)
+}
+
+// removeCompactFiles close and remove temporary files of compaction
+func removeCompactFiles(f string, fv, fk *os.File) {
+	if fv != nil {
+		fv.Close()
+	}
+	if fk != nil {
+		fk.Close()
+	}
+	os.Remove(f + compactSuffix)
+	os.Remove(f + ".idx" + compactSuffix)
+	os.Remove(f + runPrefix + compactSuffix)
+	os.Remove(f + runPrefix + compactSuffix + ".tmp")
+}
+
+// createCompactFiles create index and, if values set, value file of compaction
+func createCompactFiles(f string, mode os.FileMode, values bool) (fv, fk *os.File, err error) {
+	if values {
+		fv, err = os.OpenFile(f+compactSuffix, os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	fk, err = os.OpenFile(f+".idx"+compactSuffix, os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode)
+	return fv, fk, err
+}
+
+// swapCompactFiles sync new files and rename them over current files.
+// Index is renamed to ".compacted" first - it marks both files as complete,
+// so recoverCompaction may finish the swap after crash
+func swapCompactFiles(f string, fv, fk *os.File) error {
+	if fv != nil {
+		err := fv.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	err := fk.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f+".idx"+compactSuffix, f+".idx"+compactDone)
+	if err != nil {
+		return err
+	}
+	if fv != nil {
+		err = os.Rename(f+compactSuffix, f)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(f+".idx"+compactDone, f+".idx")
+}
+
+// recoverCompaction finish or rollback compaction, interrupted by crash
+func recoverCompaction(f string) error {
+	// run of compaction, not renamed before crash
+	os.Remove(f + runPrefix + compactSuffix)
+	_, err := os.Stat(f + ".idx" + compactDone)
+	if err == nil {
+		// both files complete - finish swap
+		err = os.Rename(f+compactSuffix, f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Rename(f+".idx"+compactDone, f+".idx")
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	// incomplete compaction - remove temporary files
+	removeCompactFiles(f, nil, nil)
+	return nil
+}
@@ -0,0 +1,228 @@
+package pudge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"math"
+)
+
+// ErrCounterType - int counter of key requested, but key has float counter
+var ErrCounterType = errors.New("Error: value is float counter")
+
+const counterSize = 8 // counters stored as 8 byte value, rewritten in place
+
+// Counter return int64 incremented on incr, missing key counted from 0.
+// Counters are atomic under lock of db and stored in 8 bytes,
+// counters stored with gob by previous versions read and converted.
+// Expiration time of key kept
+func (db *Db) Counter(key interface{}, incr int) (int64, error) {
+	return db.addCounter(key, int64(incr))
+}
+
+// Decrement return int64 counter decremented on decr, see Counter
+func (db *Db) Decrement(key interface{}, decr int) (int64, error) {
+	return db.addCounter(key, -int64(decr))
+}
+
+// GetCounter return value of int64 counter, 0 if key not exists
+func (db *Db) GetCounter(key interface{}) (int64, error) {
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return 0, err
+	}
+	db.RLock()
+	defer db.RUnlock()
+	return db.loadInt(k)
+}
+
+// ResetCounter set int or float counter to 0
+func (db *Db) ResetCounter(key interface{}) error {
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return err
+	}
+	db.Lock()
+	cmd, err := db.current(k)
+	if err == nil {
+		if cmd != nil && cmd.Flags&flagFloat != 0 {
+			err = db.storeCounter(k, 0, flagFloat)
+		} else {
+			err = db.storeCounter(k, 0, flagCounter)
+		}
+	}
+	db.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.commit()
+}
+
+// FloatCounter return float64 incremented on incr, see Counter.
+// Int counter of key converted to float counter
+func (db *Db) FloatCounter(key interface{}, incr float64) (float64, error) {
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return 0, err
+	}
+	db.Lock()
+	f, err := db.loadFloat(k)
+	if err == nil {
+		f += incr
+		err = db.storeCounter(k, math.Float64bits(f), flagFloat)
+	}
+	db.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return f, db.commit()
+}
+
+// GetFloatCounter return value of float or int counter, 0 if key not exists
+func (db *Db) GetFloatCounter(key interface{}) (float64, error) {
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return 0, err
+	}
+	db.RLock()
+	defer db.RUnlock()
+	return db.loadFloat(k)
+}
+
+func (db *Db) addCounter(key interface{}, incr int64) (int64, error) {
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return -1, err
+	}
+	db.Lock()
+	n, err := db.loadInt(k)
+	if err != nil {
+		db.Unlock()
+		return -1, err
+	}
+	n += incr
+	err = db.storeCounter(k, uint64(n), flagCounter)
+	db.Unlock()
+	if err != nil {
+		return n, err
+	}
+	return n, db.commit()
+}
+
+// loadCounter return bits of counter of key and its kind (flagCounter or flagFloat),
+// 0 of kind want if key not exists. Value without counter flags decoded with gob.
+// Caller must hold lock
+func (db *Db) loadCounter(k []byte, want uint8) (bits uint64, kind uint8, err error) {
+	cmd, err := db.current(k)
+	if err != nil || cmd == nil {
+		return 0, want, err
+	}
+	b, err := db.readValue(k, cmd)
+	if err != nil {
+		return 0, 0, err
+	}
+	kind = cmd.Flags & (flagCounter | flagFloat)
+	if kind == 0 {
+		// stored with gob, int counter or float counter of legacy format
+		var n int64
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(&n)
+		if err == nil {
+			return uint64(n), flagCounter, nil
+		}
+		var f float64
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(&f)
+		return math.Float64bits(f), flagFloat, err
+	}
+	if len(b) != counterSize {
+		return 0, 0, &ErrCorrupted{File: db.name, Offset: int64(cmd.Seek), Key: k}
+	}
+	return binary.BigEndian.Uint64(b), kind, nil
+}
+
+// loadInt return int counter of key. Caller must hold lock
+func (db *Db) loadInt(k []byte) (int64, error) {
+	bits, kind, err := db.loadCounter(k, flagCounter)
+	if err == nil && kind == flagFloat {
+		err = ErrCounterType
+	}
+	return int64(bits), err
+}
+
+// loadFloat return float counter or converted int counter of key. Caller must hold lock
+func (db *Db) loadFloat(k []byte) (float64, error) {
+	bits, kind, err := db.loadCounter(k, flagFloat)
+	if kind == flagCounter {
+		return float64(int64(bits)), err
+	}
+	return math.Float64frombits(bits), err
+}
+
+// storeCounter store bits of counter of kind flagCounter or flagFloat,
+// legacy formats without value flags store counters with gob. Caller must hold lock
+func (db *Db) storeCounter(k []byte, bits uint64, kind uint8) error {
+	var expire uint32
+	cmd, err := db.current(k)
+	if err != nil {
+		return err
+	}
+	if cmd != nil {
+		expire = cmd.Expire
+	}
+	if db.format < formatV4 {
+		var v []byte
+		if kind == flagFloat {
+			v, err = ValToBinary(math.Float64frombits(bits))
+		} else {
+			v, err = ValToBinary(int64(bits))
+		}
+		if err != nil {
+			return err
+		}
+		return db.set(k, v, expire)
+	}
+	v := make([]byte, counterSize)
+	binary.BigEndian.PutUint64(v, bits)
+	return db.setValue(k, v, expire, kind)
+}
+
+// decodeCounter store counter b of kind in flags to *int64, *int or *float64,
+// int counter converted to float. *[]byte get counter encoded with gob,
+// as Get returned it before counters stored in 8 bytes.
+// Return false if b is not counter or value of other type
+func decodeCounter(b []byte, flags uint8, value interface{}) (bool, error) {
+	kind := flags & (flagCounter | flagFloat)
+	if kind == 0 || len(b) != counterSize {
+		return false, nil
+	}
+	bits := binary.BigEndian.Uint64(b)
+	switch v := value.(type) {
+	case *[]byte:
+		var err error
+		if kind == flagFloat {
+			*v, err = ValToBinary(math.Float64frombits(bits))
+		} else {
+			*v, err = ValToBinary(int64(bits))
+		}
+		return true, err
+	case *int64:
+		if kind == flagFloat {
+			return true, ErrCounterType
+		}
+		*v = int64(bits)
+	case *int:
+		if kind == flagFloat {
+			return true, ErrCounterType
+		}
+		*v = int(int64(bits))
+	case *float64:
+		if kind == flagFloat {
+			*v = math.Float64frombits(bits)
+		} else {
+			*v = float64(int64(bits))
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
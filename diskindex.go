@@ -0,0 +1,978 @@
+package pudge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	runPrefix   = ".run" // run files: name.run<lo>-<hi>
+	runBlock    = 64     // records in block of run, first key of block kept in memory
+	runFooter   = 104    // size of run footer
+	runMagic    = "pudgeru2"
+	runFooterV1 = 96 // footer without version
+	runMagicV1  = "pudgerun"
+	runPrint    = 256           // bytes of index log before watermark, checked on open
+	flagDeleted = uint8(1 << 7) // memtable and runs only: key deleted
+	flagVersion = uint8(1 << 6) // runs only: varint version after expire
+
+	defaultMemtable = 100000
+)
+
+// ErrIndexMode - index mode not supported with config
+var ErrIndexMode = errors.New("Error: IndexDisk not supported with EncryptKeys")
+
+// diskIndex keeps records in sorted immutable run files and recent changes in memtable
+// only first key of every block of run kept in memory
+// full memtable written as new run, runs of similar size merged, so
+// there are O(log n) runs and every record rewritten O(log n) times
+type diskIndex struct {
+	stats BloomStats // first for atomic alignment
+	name  string
+	mode  os.FileMode
+	limit int     // max keys in memtable
+	fp    float64 // false positive rate of bloom filters, 0 - no filters
+	mem   *packedIndex
+	runs  []*run // from oldest to newest
+	state runState
+	// hi of run written by Compact, runs not merged while set
+	reserved uint64
+	errMu    sync.Mutex
+	err      error // first read error
+	closed   bool
+}
+
+// run - sorted records with sparse index
+type run struct {
+	f      *os.File
+	file   string // name of file, f may be opened with temporary name
+	lo, hi uint64 // numbers of flushes merged in run
+	recs   int64  // records in run, deleted included
+	end    int64  // size of records, sparse index follows
+	sparse []sparseKey
+	bloom  *bloom // filter of keys, nil - none
+	state  runState
+}
+
+// sparseKey - first key, offset and crc32c of block
+type sparseKey struct {
+	key []byte
+	off int64
+	crc uint32
+}
+
+// runState - state of db when run written
+type runState struct {
+	watermark int64  // size of index log applied to runs
+	print     uint32 // crc32c of index log bytes before watermark
+	count     int64  // live keys
+	live      int64  // bytes of live values and index records
+	expiring  int64  // keys with expiration time
+	version   uint64 // highest version given to key
+}
+
+type runRec struct {
+	key []byte
+	cmd Cmd
+}
+
+func runName(name string, lo, hi uint64) string {
+	return fmt.Sprintf("%s%s%d-%d", name, runPrefix, lo, hi)
+}
+
+type runFile struct {
+	file   string
+	lo, hi uint64
+	tmp    bool
+}
+
+// listRuns return run files of db, temporary files included
+func listRuns(name string) (files []runFile, err error) {
+	dir := filepath.Dir(name)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Base(name)
+	for _, fi := range infos {
+		rf := runFile{file: filepath.Join(dir, fi.Name())}
+		n := strings.TrimSuffix(fi.Name(), ".tmp")
+		rf.tmp = n != fi.Name()
+		if !strings.HasPrefix(n, base+runPrefix) {
+			continue
+		}
+		_, err := fmt.Sscanf(n[len(base+runPrefix):], "%d-%d", &rf.lo, &rf.hi)
+		if err == nil && n == filepath.Base(runName(name, rf.lo, rf.hi)) {
+			files = append(files, rf)
+		}
+	}
+	return files, nil
+}
+
+// removeRuns delete run files of db
+func removeRuns(name string) {
+	files, _ := listRuns(name)
+	for _, rf := range files {
+		os.Remove(rf.file)
+	}
+}
+
+// logPrint return fingerprint of index log before watermark
+func logPrint(fk *os.File, watermark int64) (uint32, error) {
+	n := int64(runPrint)
+	if watermark < n {
+		n = watermark
+	}
+	b := make([]byte, n)
+	_, err := fk.ReadAt(b, watermark-n)
+	return crc32.Checksum(b, crcTable), err
+}
+
+// openDiskIndex load runs of db, runs not matched with index log fk
+// are removed and index log must be replayed from start
+// filters of runs loaded if fp > 0
+func openDiskIndex(name string, fk *os.File, mode os.FileMode, limit int, fp float64) (*diskIndex, error) {
+	if limit <= 0 {
+		limit = defaultMemtable
+	}
+	if fp < 0 || fp >= 1 {
+		fp = 0
+	}
+	d := &diskIndex{name: name, mode: mode, limit: limit, fp: fp, mem: newPackedIndex()}
+	files, err := listRuns(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, rf := range files {
+		if rf.tmp {
+			os.Remove(rf.file)
+			continue
+		}
+		r, err := openRun(rf.file, rf.lo, rf.hi)
+		if err != nil {
+			d.close()
+			return nil, err
+		}
+		if fp == 0 {
+			r.bloom = nil
+		}
+		d.runs = append(d.runs, r)
+	}
+	// drop runs merged in other runs
+	sort.Slice(d.runs, func(i, j int) bool {
+		if d.runs[i].lo == d.runs[j].lo {
+			return d.runs[i].hi > d.runs[j].hi
+		}
+		return d.runs[i].lo < d.runs[j].lo
+	})
+	runs := d.runs[:0]
+	for _, r := range d.runs {
+		if len(runs) > 0 && r.hi <= runs[len(runs)-1].hi {
+			r.remove()
+			continue
+		}
+		runs = append(runs, r)
+	}
+	d.runs = runs
+	if len(d.runs) == 0 {
+		return d, nil
+	}
+	d.state = d.runs[len(d.runs)-1].state
+	if !matchLog(fk, d.state) {
+		// index log rewritten by compaction
+		for _, r := range d.runs {
+			r.remove()
+		}
+		d.runs, d.state = nil, runState{}
+	}
+	return d, nil
+}
+
+// openRun read footer and sparse index of run file
+func openRun(file string, lo, hi uint64) (*run, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	r := &run{f: f, file: file, lo: lo, hi: hi}
+	err = r.load()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *run) load() error {
+	stat, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	corrupted := &ErrCorrupted{File: r.file, Offset: size - runFooterV1}
+	if size < runFooterV1 {
+		return corrupted
+	}
+	magic := make([]byte, len(runMagic))
+	_, err = r.f.ReadAt(magic, size-int64(len(magic)))
+	if err != nil {
+		return err
+	}
+	n := int64(runFooter)
+	switch {
+	case string(magic) == runMagicV1:
+		n = runFooterV1
+	case string(magic) != runMagic || size < n:
+		return corrupted
+	}
+	corrupted.Offset = size - n
+	foot := make([]byte, n)
+	_, err = r.f.ReadAt(foot, size-n)
+	if err != nil {
+		return err
+	}
+	u := func(i int) int64 {
+		return int64(binary.BigEndian.Uint64(foot[i*8:]))
+	}
+	r.end, r.recs = u(0), u(3)
+	r.state = runState{watermark: u(4), count: u(5), live: u(6), expiring: u(7),
+		print: binary.BigEndian.Uint32(foot[n-16:])}
+	if n == runFooter {
+		r.state.version = uint64(u(10))
+	}
+	sparse := u(1)
+	if r.end < 0 || sparse < r.end || sparse > size-n || uint64(u(8)) != r.lo || uint64(u(9)) != r.hi {
+		return corrupted
+	}
+	b := make([]byte, size-n-r.end)
+	_, err = r.f.ReadAt(b, r.end)
+	if err != nil {
+		return err
+	}
+	crc := crc32.Update(crc32.Checksum(b, crcTable), crcTable, foot[:n-12])
+	if crc != binary.BigEndian.Uint32(foot[n-12:]) {
+		corrupted.Offset = r.end
+		return corrupted
+	}
+	if sparse > r.end {
+		r.bloom = decodeBloom(b[:sparse-r.end])
+		if r.bloom == nil {
+			return corrupted
+		}
+	}
+	b = b[sparse-r.end:]
+	r.sparse = make([]sparseKey, 0, u(2))
+	for len(b) > 0 {
+		size, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < size+12 {
+			return corrupted
+		}
+		b = b[n:]
+		r.sparse = append(r.sparse, sparseKey{
+			key: b[:size:size],
+			off: int64(binary.BigEndian.Uint64(b[size:])),
+			crc: binary.BigEndian.Uint32(b[size+8:]),
+		})
+		b = b[size+12:]
+	}
+	return nil
+}
+
+func (r *run) remove() {
+	r.f.Close()
+	os.Remove(r.file)
+}
+
+// writeRun write records from walk to new run file, n - expected records
+// deleted records skipped if drop set
+func (d *diskIndex) writeRun(lo, hi uint64, state *runState, n int64, drop bool, walk func(fn func(k []byte, cmd *Cmd) bool)) (*run, error) {
+	return writeRunFile(runName(d.name, lo, hi), d.mode, lo, hi, state, n, d.fp, drop, walk)
+}
+
+// writeRunFile write records from walk to temporary file and rename it to file
+// bloom filter for n keys written if fp > 0, state read after walk
+func writeRunFile(file string, mode os.FileMode, lo, hi uint64, state *runState, n int64, fp float64, drop bool, walk func(fn func(k []byte, cmd *Cmd) bool)) (*run, error) {
+	f, err := os.OpenFile(file+".tmp", os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+	r := &run{f: f, file: file, lo: lo, hi: hi}
+	if fp > 0 {
+		r.bloom = newBloom(n, fp)
+	}
+	w := bufio.NewWriterSize(f, 1<<16)
+	var b []byte
+	walk(func(k []byte, cmd *Cmd) bool {
+		if drop && cmd.Flags&flagDeleted != 0 {
+			return true
+		}
+		if r.recs%runBlock == 0 {
+			r.sparse = append(r.sparse, sparseKey{key: append([]byte(nil), k...), off: r.end})
+		}
+		if r.bloom != nil {
+			// deleted keys added too, they hide records of older runs
+			r.bloom.add(bloomHash(k))
+		}
+		b = appendRunRec(b[:0], k, cmd)
+		s := &r.sparse[len(r.sparse)-1]
+		s.crc = crc32.Update(s.crc, crcTable, b)
+		_, err = w.Write(b)
+		r.end += int64(len(b))
+		r.recs++
+		return err == nil
+	})
+	if err == nil {
+		r.state = *state
+		b = b[:0]
+		if r.bloom != nil {
+			b = r.bloom.append(b)
+		}
+		sparse := r.end + int64(len(b))
+		for _, s := range r.sparse {
+			b = appendUvarint(b, uint64(len(s.key)))
+			b = append(b, s.key...)
+			b = appendUint64(b, uint64(s.off))
+			b = appendUint32(b, s.crc)
+		}
+		crc := crc32.Checksum(b, crcTable)
+		foot := make([]byte, 0, runFooter)
+		for _, v := range []int64{r.end, sparse, int64(len(r.sparse)), r.recs, r.state.watermark,
+			r.state.count, r.state.live, r.state.expiring, int64(lo), int64(hi), int64(r.state.version)} {
+			foot = appendUint64(foot, uint64(v))
+		}
+		foot = appendUint32(foot, r.state.print)
+		foot = appendUint32(foot, crc32.Update(crc, crcTable, foot))
+		foot = append(foot, runMagic...)
+		_, err = w.Write(append(b, foot...))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(file + ".tmp")
+		return nil, err
+	}
+	return r, nil
+}
+
+// appendRunRec append record of run:
+// flags 1, seek 8, size 8, keyseek 8, checksum 4, expire 4,
+// varint version (with flagVersion), varint key size, key
+func appendRunRec(b []byte, k []byte, cmd *Cmd) []byte {
+	flags := cmd.Flags
+	if cmd.Version != 0 {
+		flags |= flagVersion
+	}
+	b = append(b, flags)
+	b = appendUint64(b, cmd.Seek)
+	b = appendUint64(b, cmd.Size)
+	b = appendUint64(b, cmd.KeySeek)
+	b = appendUint32(b, cmd.Checksum)
+	b = appendUint32(b, cmd.Expire)
+	if cmd.Version != 0 {
+		b = appendUvarint(b, cmd.Version)
+	}
+	b = appendUvarint(b, uint64(len(k)))
+	return append(b, k...)
+}
+
+func decodeRunRec(b []byte) (rec runRec, n int, err error) {
+	if len(b) < 34 {
+		return rec, 0, errBadRecord
+	}
+	rec.cmd = Cmd{
+		Flags:    b[0] &^ flagVersion,
+		Seek:     binary.BigEndian.Uint64(b[1:]),
+		Size:     binary.BigEndian.Uint64(b[9:]),
+		KeySeek:  binary.BigEndian.Uint64(b[17:]),
+		Checksum: binary.BigEndian.Uint32(b[25:]),
+		Expire:   binary.BigEndian.Uint32(b[29:]),
+	}
+	n = 33
+	if b[0]&flagVersion != 0 {
+		v, l := binary.Uvarint(b[n:])
+		if l <= 0 {
+			return rec, 0, errBadRecord
+		}
+		rec.cmd.Version = v
+		n += l
+	}
+	size, l := binary.Uvarint(b[n:])
+	n += l
+	if l <= 0 || uint64(len(b)-n) < size {
+		return rec, 0, errBadRecord
+	}
+	rec.key = b[n : n+int(size) : n+int(size)]
+	return rec, n + int(size), nil
+}
+
+// block read and decode records of block bi
+func (r *run) block(bi int) ([]runRec, error) {
+	off, end := r.sparse[bi].off, r.end
+	if bi+1 < len(r.sparse) {
+		end = r.sparse[bi+1].off
+	}
+	b := make([]byte, end-off)
+	_, err := r.f.ReadAt(b, off)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(b, crcTable) != r.sparse[bi].crc {
+		return nil, &ErrCorrupted{File: r.file, Offset: off}
+	}
+	recs := make([]runRec, 0, runBlock)
+	for len(b) > 0 {
+		rec, n, err := decodeRunRec(b)
+		if err != nil {
+			return nil, &ErrCorrupted{File: r.file, Offset: off}
+		}
+		recs = append(recs, rec)
+		b = b[n:]
+		off += int64(n)
+	}
+	return recs, nil
+}
+
+// get return record of key from run
+func (r *run) get(k []byte) (*Cmd, bool, error) {
+	bi := sort.Search(len(r.sparse), func(i int) bool {
+		return bytes.Compare(r.sparse[i].key, k) > 0
+	}) - 1
+	if bi < 0 {
+		return nil, false, nil
+	}
+	recs, err := r.block(bi)
+	if err != nil {
+		return nil, false, err
+	}
+	i := sort.Search(len(recs), func(i int) bool {
+		return bytes.Compare(recs[i].key, k) >= 0
+	})
+	if i == len(recs) || !bytes.Equal(recs[i].key, k) {
+		return nil, false, nil
+	}
+	return &recs[i].cmd, true, nil
+}
+
+// runCursor walk records of run in one direction
+type runCursor struct {
+	r    *run
+	asc  bool
+	bi   int
+	recs []runRec
+	i    int
+	err  error
+}
+
+// cursor return cursor at first key >= from in ascending order
+// or at last key < from in descending order, nil from - first or last key
+func (r *run) cursor(from []byte, asc bool) *runCursor {
+	c := &runCursor{r: r, asc: asc}
+	switch {
+	case from == nil && asc:
+		c.bi = 0
+	case from == nil:
+		c.bi = len(r.sparse) - 1
+	case asc:
+		c.bi = sort.Search(len(r.sparse), func(i int) bool {
+			return bytes.Compare(r.sparse[i].key, from) > 0
+		}) - 1
+		if c.bi < 0 {
+			c.bi = 0
+		}
+	default:
+		c.bi = sort.Search(len(r.sparse), func(i int) bool {
+			return bytes.Compare(r.sparse[i].key, from) >= 0
+		}) - 1
+	}
+	if c.bi < 0 || c.bi >= len(r.sparse) {
+		return c
+	}
+	c.recs, c.err = r.block(c.bi)
+	switch {
+	case from == nil && asc:
+		c.i = 0
+	case from == nil:
+		c.i = len(c.recs) - 1
+	case asc:
+		c.i = sort.Search(len(c.recs), func(i int) bool {
+			return bytes.Compare(c.recs[i].key, from) >= 0
+		})
+	default:
+		c.i = sort.Search(len(c.recs), func(i int) bool {
+			return bytes.Compare(c.recs[i].key, from) >= 0
+		}) - 1
+	}
+	c.settle()
+	return c
+}
+
+func (c *runCursor) valid() bool {
+	return c.err == nil && c.i >= 0 && c.i < len(c.recs)
+}
+
+func (c *runCursor) next() {
+	if c.asc {
+		c.i++
+	} else {
+		c.i--
+	}
+	c.settle()
+}
+
+// settle move cursor to next block if position out of block
+func (c *runCursor) settle() {
+	for c.err == nil && (c.i < 0 || c.i >= len(c.recs)) {
+		if c.asc {
+			c.bi++
+		} else {
+			c.bi--
+		}
+		if c.bi < 0 || c.bi >= len(c.r.sparse) {
+			c.recs = nil
+			return
+		}
+		c.recs, c.err = c.r.block(c.bi)
+		c.i = 0
+		if !c.asc {
+			c.i = len(c.recs) - 1
+		}
+	}
+}
+
+// mergeCursor walk records of runs in order, newer record of key wins
+type mergeCursor struct {
+	cs  []*runCursor // from oldest run to newest
+	asc bool
+	cur int // cursor of current record, -1 - end
+}
+
+func (d *diskIndex) cursor(runs []*run, from []byte, asc bool) *mergeCursor {
+	m := &mergeCursor{asc: asc}
+	for _, r := range runs {
+		m.cs = append(m.cs, r.cursor(from, asc))
+	}
+	m.settle()
+	return m
+}
+
+func (m *mergeCursor) settle() {
+	m.cur = -1
+	for i, c := range m.cs {
+		if !c.valid() {
+			continue
+		}
+		if m.cur < 0 {
+			m.cur = i
+			continue
+		}
+		cmp := bytes.Compare(c.recs[c.i].key, m.rec().key)
+		if cmp == 0 || (cmp < 0) == m.asc {
+			m.cur = i
+		}
+	}
+}
+
+func (m *mergeCursor) valid() bool {
+	return m.cur >= 0
+}
+
+func (m *mergeCursor) rec() *runRec {
+	c := m.cs[m.cur]
+	return &c.recs[c.i]
+}
+
+func (m *mergeCursor) next() {
+	k := m.rec().key
+	for _, c := range m.cs {
+		if c.valid() && bytes.Equal(c.recs[c.i].key, k) {
+			c.next()
+		}
+	}
+	m.settle()
+}
+
+// readErr return first read error of cursors
+func (m *mergeCursor) readErr() error {
+	for _, c := range m.cs {
+		if c.err != nil {
+			return c.err
+		}
+	}
+	return nil
+}
+
+func (d *diskIndex) fail(err error) {
+	d.errMu.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.errMu.Unlock()
+}
+
+// readErr return first read error of runs
+func (d *diskIndex) readErr() error {
+	d.errMu.Lock()
+	defer d.errMu.Unlock()
+	return d.err
+}
+
+func (d *diskIndex) get(k []byte) (*Cmd, bool) {
+	cmd, ok := d.mem.get(k)
+	if !ok && d.fp > 0 && len(d.runs) > 0 {
+		return d.filteredGet(k)
+	}
+	for i := len(d.runs) - 1; !ok && i >= 0; i-- {
+		var err error
+		cmd, ok, err = d.runs[i].get(k)
+		if err != nil {
+			d.fail(err)
+			return nil, false
+		}
+	}
+	if !ok || cmd.Flags&flagDeleted != 0 {
+		return nil, false
+	}
+	return cmd, true
+}
+
+// filteredGet return record of key from runs, runs without key skipped by filters
+func (d *diskIndex) filteredGet(k []byte) (*Cmd, bool) {
+	atomic.AddInt64(&d.stats.Lookups, 1)
+	h := bloomHash(k)
+	var cmd *Cmd
+	ok, read := false, false
+	for i := len(d.runs) - 1; !ok && i >= 0; i-- {
+		r := d.runs[i]
+		if r.bloom != nil && !r.bloom.has(h) {
+			continue
+		}
+		var err error
+		cmd, ok, err = r.get(k)
+		if err != nil {
+			d.fail(err)
+			return nil, false
+		}
+		read = true
+		if !ok && r.bloom != nil {
+			atomic.AddInt64(&d.stats.FalsePositives, 1)
+		}
+	}
+	if !read {
+		atomic.AddInt64(&d.stats.Negatives, 1)
+	}
+	if !ok || cmd.Flags&flagDeleted != 0 {
+		return nil, false
+	}
+	return cmd, true
+}
+
+func (d *diskIndex) put(k []byte, cmd *Cmd) {
+	if _, ok := d.get(k); !ok {
+		d.state.count++
+	}
+	d.mem.put(k, cmd)
+}
+
+func (d *diskIndex) remove(k []byte) {
+	if _, ok := d.get(k); ok {
+		d.state.count--
+		d.mem.put(k, &Cmd{Flags: flagDeleted})
+	}
+}
+
+func (d *diskIndex) len() int {
+	return int(d.state.count)
+}
+
+func (d *diskIndex) ascend(from []byte, fn func(k []byte, cmd *Cmd) bool) {
+	d.walk(from, true, fn)
+}
+
+func (d *diskIndex) descend(before []byte, fn func(k []byte, cmd *Cmd) bool) {
+	d.walk(before, false, fn)
+}
+
+// walk merge records of memtable and runs, memtable wins
+func (d *diskIndex) walk(from []byte, asc bool, fn func(k []byte, cmd *Cmd) bool) {
+	if err := d.walkMerged(d.mem, d.runs, from, asc, fn); err != nil {
+		d.fail(err)
+	}
+}
+
+// walkMerged merge records of memtable mem and runs, mem wins,
+// return read error of runs
+func (d *diskIndex) walkMerged(mem *packedIndex, runs []*run, from []byte, asc bool, fn func(k []byte, cmd *Cmd) bool) error {
+	m := d.cursor(runs, from, asc)
+	stopped := false
+	// emit records of runs before key k (nil - all)
+	emit := func(k []byte) bool {
+		for m.valid() {
+			rec := m.rec()
+			cmp := 0
+			if k != nil {
+				cmp = bytes.Compare(rec.key, k)
+			}
+			if k != nil && (cmp == 0 || (cmp > 0) == asc) {
+				if cmp == 0 {
+					m.next()
+				}
+				return true
+			}
+			if rec.cmd.Flags&flagDeleted == 0 && !fn(rec.key, &rec.cmd) {
+				return false
+			}
+			m.next()
+		}
+		return true
+	}
+	memFn := func(k []byte, cmd *Cmd) bool {
+		if !emit(k) {
+			stopped = true
+			return false
+		}
+		if cmd.Flags&flagDeleted == 0 && !fn(k, cmd) {
+			stopped = true
+			return false
+		}
+		return true
+	}
+	if asc {
+		mem.ascend(from, memFn)
+	} else {
+		mem.descend(from, memFn)
+	}
+	if !stopped {
+		emit(nil)
+	}
+	return m.readErr()
+}
+
+// full return true if memtable must be flushed
+func (d *diskIndex) full() bool {
+	return d.mem.len() >= d.limit
+}
+
+// flush write memtable to new run and merge runs of similar size
+func (d *diskIndex) flush(state runState) error {
+	state.count = d.state.count
+	seq := uint64(1)
+	if n := len(d.runs); n > 0 {
+		seq = d.runs[n-1].hi + 1
+	}
+	if seq <= d.reserved {
+		seq = d.reserved + 1
+	}
+	r, err := d.writeRun(seq, seq, &state, int64(d.mem.len()), len(d.runs) == 0, func(fn func(k []byte, cmd *Cmd) bool) {
+		d.mem.ascend(nil, fn)
+	})
+	if err != nil {
+		return err
+	}
+	d.runs = append(d.runs, r)
+	d.mem = newPackedIndex()
+	d.state = state
+	for n := len(d.runs); d.reserved == 0 && n >= 2 && d.runs[n-2].recs <= 2*d.runs[n-1].recs; n = len(d.runs) {
+		err = d.merge(n - 2)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge join runs i and i+1, deleted records dropped in oldest run
+func (d *diskIndex) merge(i int) error {
+	a, b := d.runs[i], d.runs[i+1]
+	var readErr error
+	r, err := d.writeRun(a.lo, b.hi, &b.state, a.recs+b.recs, i == 0, func(fn func(k []byte, cmd *Cmd) bool) {
+		m := d.cursor(d.runs[i:i+2], nil, true)
+		for m.valid() && fn(m.rec().key, &m.rec().cmd) {
+			m.next()
+		}
+		readErr = m.readErr()
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		if r != nil {
+			r.remove()
+		}
+		return err
+	}
+	a.remove()
+	b.remove()
+	d.runs[i] = r
+	d.runs = append(d.runs[:i+1], d.runs[i+2:]...)
+	return nil
+}
+
+func (d *diskIndex) close() {
+	for _, r := range d.runs {
+		r.f.Close()
+	}
+	d.closed = true
+}
+
+// diskIndex return disk index of db or nil
+func (db *Db) diskIndex() *diskIndex {
+	d, _ := db.index.(*diskIndex)
+	return d
+}
+
+// indexErr return read error of disk index
+func (db *Db) indexErr() error {
+	if d := db.diskIndex(); d != nil {
+		return d.readErr()
+	}
+	return nil
+}
+
+// flushIndex write memtable of disk index to run if memtable is full,
+// caller must hold lock. Files synced first, so run never point to lost records.
+// Memtable not written while batch in progress, runs never contain part of batch
+func (db *Db) flushIndex() error {
+	d := db.diskIndex()
+	if d == nil || !d.full() || db.batching {
+		return nil
+	}
+	state, err := db.logState()
+	if err != nil {
+		return err
+	}
+	return d.flush(state)
+}
+
+// compactDisk stream live records of memtable and runs to new files and to new run,
+// which replace current runs. Runs not merged while records copied,
+// only memtable copied in memory. Called with lock held, release it
+func (db *Db) compactDisk(d *diskIndex, segmented bool) error {
+	src, format := db.fv, db.format
+	mem := newPackedIndex()
+	d.mem.ascend(nil, func(k []byte, cmd *Cmd) bool {
+		mem.put(k, cmd)
+		return true
+	})
+	runs := append([]*run(nil), d.runs...)
+	lo, hi := uint64(1), uint64(1)
+	if n := len(runs); n > 0 {
+		lo, hi = runs[0].lo, runs[n-1].hi+1
+	}
+	d.reserved = hi
+	count, version := d.state.count, db.version
+	db.dirty = make(map[string]struct{})
+	db.Unlock()
+
+	fv, fk, err := createCompactFiles(db.name, os.FileMode(db.config.FileMode), !segmented)
+	var r *run
+	var state runState
+	if err == nil {
+		// copy values, readers and writers use old files and runs
+		var copyErr error
+		r, err = writeRunFile(db.name+runPrefix+compactSuffix, d.mode, lo, hi, &state, count, d.fp, true,
+			func(fn func(k []byte, cmd *Cmd) bool) {
+				walkErr := d.walkMerged(mem, runs, nil, true, func(k []byte, old *Cmd) bool {
+					cmd, err := db.copyKey(src, fv, fk, format, k, old)
+					if err != nil {
+						copyErr = err
+						return false
+					}
+					state.count++
+					state.live += int64(cmd.Size) + db.keyRecordSize(k)
+					if cmd.Expire != 0 {
+						state.expiring++
+					}
+					return fn(k, cmd)
+				})
+				if copyErr == nil {
+					copyErr = walkErr
+				}
+				state.version = version
+				if copyErr == nil {
+					state.watermark, copyErr = fk.Seek(0, io.SeekEnd)
+				}
+				if copyErr == nil {
+					state.print, copyErr = logPrint(fk, state.watermark)
+				}
+			})
+		if err == nil {
+			err = copyErr
+		}
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	d.reserved = 0
+	live := state.live
+	newVals := make(map[string]*Cmd, len(db.dirty))
+	for k := range db.dirty {
+		if err != nil {
+			break
+		}
+		// records of new run replaced by replay
+		cmd, ok, rerr := r.get([]byte(k))
+		if ok {
+			newVals[k] = cmd
+			live -= int64(cmd.Size) + db.keyRecordSize([]byte(k))
+		}
+		err = rerr
+	}
+	if err == nil {
+		err = db.replayDirty(fv, fk, newVals)
+	}
+	if err == nil {
+		err = swapCompactFiles(db.name, fv, fk)
+	}
+	dirty := db.dirty
+	db.dirty = nil
+	if err != nil {
+		if r != nil {
+			r.remove()
+		}
+		removeCompactFiles(db.name, fv, fk)
+		return err
+	}
+	db.useCompactFiles(fv, fk)
+	// without run under its name index log replayed from start on open
+	file := runName(db.name, lo, hi)
+	if os.Rename(r.file, file) == nil {
+		r.file = file
+	}
+	for _, old := range d.runs {
+		old.remove()
+	}
+	d.runs = []*run{r}
+	d.mem = newPackedIndex()
+	d.state = r.state
+	for k := range dirty {
+		key := []byte(k)
+		if cmd, ok := newVals[k]; ok {
+			d.put(key, cmd)
+			live += int64(cmd.Size) + db.keyRecordSize(key)
+		} else {
+			d.remove(key)
+		}
+	}
+	db.used += live
+	return nil
+}
@@ -0,0 +1,96 @@
+package pudge
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// ErrEncryption - data encrypted with other key or key not set
+var ErrEncryption = errors.New("Error: wrong or missing encryption key")
+
+// KeyProvider return AES key (16, 24 or 32 bytes), see Config.KeyProvider
+type KeyProvider interface {
+	Key() ([]byte, error)
+}
+
+// newAEAD return AES-GCM cipher for key from Config or nil if key not set
+func newAEAD(cfg *Config) (cipher.AEAD, error) {
+	key := cfg.EncryptionKey
+	if cfg.KeyProvider != nil {
+		var err error
+		key, err = cfg.KeyProvider.Key()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if key == nil {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal return nonce with encrypted b, ad authenticated with b but not stored
+func (db *Db) seal(b, ad []byte) ([]byte, error) {
+	nonce := make([]byte, db.aead.NonceSize(), db.aead.NonceSize()+len(b)+db.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return db.aead.Seal(nonce, nonce, b, ad), nil
+}
+
+// open return decrypted b, sealed by seal with same ad
+func (db *Db) open(b, ad []byte) ([]byte, error) {
+	if db.aead == nil || len(b) < db.aead.NonceSize() {
+		return nil, ErrEncryption
+	}
+	n := db.aead.NonceSize()
+	plain, err := db.aead.Open(nil, b[:n], b[n:], ad)
+	if err != nil {
+		return nil, ErrEncryption
+	}
+	return plain, nil
+}
+
+// sealKey return key for index record and set key flag in cmd
+func (db *Db) sealKey(k []byte, cmd *Cmd) ([]byte, error) {
+	if !db.config.EncryptKeys || db.aead == nil {
+		cmd.Flags &^= flagKeyEncrypted
+		return k, nil
+	}
+	cmd.Flags |= flagKeyEncrypted
+	return db.seal(k, nil)
+}
+
+// keyRecordSize return size of index record for key k
+func (db *Db) keyRecordSize(k []byte) int64 {
+	return recordLen(db.format, db.keySize(k))
+}
+
+// keySize return size of key k in index record
+func (db *Db) keySize(k []byte) int {
+	if db.config.EncryptKeys && db.aead != nil {
+		return len(k) + db.aead.NonceSize() + db.aead.Overhead()
+	}
+	return len(k)
+}
+
+// checkEncryption try to decrypt first encrypted value
+// so Open fails with wrong key instead of returning junk
+func (db *Db) checkEncryption() error {
+	var err error
+	db.index.ascend(nil, func(k []byte, cmd *Cmd) bool {
+		if cmd.Flags&flagEncrypted != 0 {
+			_, err = db.readValue(k, cmd)
+			return false
+		}
+		return true
+	})
+	return err
+}
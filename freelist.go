@@ -0,0 +1,103 @@
+package pudge
+
+import "sort"
+
+// hole represent free space in value file
+type hole struct {
+	seek uint64
+	size uint64
+}
+
+func lessHole(a, b hole) bool {
+	if a.size == b.size {
+		return a.seek < b.seek
+	}
+	return a.size < b.size
+}
+
+// buildHoles fill free list with gaps between live values
+func (db *Db) buildHoles(fileSize uint64) {
+	vals := make([]hole, 0, db.index.len())
+	db.index.ascend(nil, func(k []byte, cmd *Cmd) bool {
+		vals = append(vals, hole{seek: cmd.Seek, size: cmd.Size})
+		return true
+	})
+	sort.Slice(vals, func(i, j int) bool {
+		return vals[i].seek < vals[j].seek
+	})
+	db.holes = db.holes[:0]
+	var end uint64
+	for _, val := range vals {
+		if val.seek > end {
+			db.insertHole(hole{seek: end, size: val.seek - end})
+		}
+		if val.seek+val.size > end {
+			end = val.seek + val.size
+		}
+	}
+	if fileSize > end {
+		db.insertHole(hole{seek: end, size: fileSize - end})
+	}
+}
+
+// allocHole return seek of best fit hole for value of size n
+// or -1 if no hole found
+func (db *Db) allocHole(n uint64) int64 {
+	i := sort.Search(len(db.holes), func(i int) bool {
+		return db.holes[i].size >= n
+	})
+	if n == 0 || i == len(db.holes) {
+		return -1
+	}
+	h := db.holes[i]
+	db.holes = append(db.holes[:i], db.holes[i+1:]...)
+	if h.size > n {
+		db.insertHole(hole{seek: h.seek + n, size: h.size - n})
+	}
+	// value will be counted by track as appended, but file not grows
+	db.used -= int64(n)
+	db.garbage -= int64(n)
+	return int64(h.seek)
+}
+
+// freeHole add space of dead value to free list
+// in AppendOnly mode space stay pending until sync, because old
+// index records may point to it after crash
+func (db *Db) freeHole(seek, size uint64) {
+	if size == 0 || db.storemode == 2 || db.segs != nil {
+		return
+	}
+	if db.batching {
+		db.deferred = append(db.deferred, hole{seek: seek, size: size})
+		return
+	}
+	if len(db.snaps) > 0 {
+		db.held = append(db.held, hole{seek: seek, size: size})
+		return
+	}
+	if db.config.AppendOnly {
+		db.pending = append(db.pending, hole{seek: seek, size: size})
+		return
+	}
+	db.insertHole(hole{seek: seek, size: size})
+}
+
+// releasePending move n first pending holes to free list
+func (db *Db) releasePending(n int) {
+	if n > len(db.pending) {
+		n = len(db.pending)
+	}
+	for _, h := range db.pending[:n] {
+		db.insertHole(h)
+	}
+	db.pending = append(db.pending[:0], db.pending[n:]...)
+}
+
+func (db *Db) insertHole(h hole) {
+	i := sort.Search(len(db.holes), func(i int) bool {
+		return !lessHole(db.holes[i], h)
+	})
+	db.holes = append(db.holes, hole{})
+	copy(db.holes[i+1:], db.holes[i:])
+	db.holes[i] = h
+}
@@ -0,0 +1,89 @@
+package pudge
+
+// Index modes
+const (
+	// IndexMap - hash map for lookup and skiplist for ordered scan
+	IndexMap = 0
+	// IndexPacked - sorted blocks of packed records with keys in arena,
+	// several times less memory per key, lookup O(log n)
+	IndexPacked = 1
+	// IndexDisk - sorted run files with first key of every block in memory,
+	// recent changes in memtable (Config.MemtableKeys), lookup read block of every run
+	IndexDisk = 2
+)
+
+// index keeps records of keys in binary order
+// Cmd passed to ascend/descend callbacks valid only during call
+type index interface {
+	get(k []byte) (*Cmd, bool)
+	// put insert or replace record of key
+	put(k []byte, cmd *Cmd)
+	remove(k []byte)
+	len() int
+	// ascend call fn for keys >= from (nil - all keys) in ascending order while fn return true
+	ascend(from []byte, fn func(k []byte, cmd *Cmd) bool)
+	// descend call fn for keys < before (nil - all keys) in descending order while fn return true
+	descend(before []byte, fn func(k []byte, cmd *Cmd) bool)
+}
+
+// newIndex return in memory index for mode, memory first store keeps values in Cmd
+// and always use map index, disk index opened with openDiskIndex
+func newIndex(mode, storemode int) index {
+	if mode == IndexPacked && storemode != 2 {
+		return newPackedIndex()
+	}
+	return &mapIndex{keys: newSkiplist(), vals: make(map[string]*Cmd)}
+}
+
+// mapIndex - default index, O(1) lookup
+type mapIndex struct {
+	keys *skiplist
+	vals map[string]*Cmd
+}
+
+func (m *mapIndex) get(k []byte) (*Cmd, bool) {
+	cmd, ok := m.vals[string(k)]
+	return cmd, ok
+}
+
+func (m *mapIndex) put(k []byte, cmd *Cmd) {
+	if _, exists := m.vals[string(k)]; !exists {
+		m.keys.insert(append([]byte(nil), k...))
+	}
+	m.vals[string(k)] = cmd
+}
+
+func (m *mapIndex) remove(k []byte) {
+	if _, exists := m.vals[string(k)]; exists {
+		delete(m.vals, string(k))
+		m.keys.remove(k)
+	}
+}
+
+func (m *mapIndex) len() int {
+	return m.keys.length
+}
+
+func (m *mapIndex) ascend(from []byte, fn func(k []byte, cmd *Cmd) bool) {
+	n := m.keys.first()
+	if from != nil {
+		n = m.keys.seek(from)
+	}
+	for ; n != nil; n = n.step(true) {
+		if !fn(n.key, m.vals[string(n.key)]) {
+			return
+		}
+	}
+}
+
+func (m *mapIndex) descend(before []byte, fn func(k []byte, cmd *Cmd) bool) {
+	n := m.keys.last()
+	if before != nil {
+		n = m.keys.seekLess(before)
+	}
+	for ; n != nil; n = n.step(false) {
+		if !fn(n.key, m.vals[string(n.key)]) {
+			return
+		}
+	}
+}
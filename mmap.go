@@ -0,0 +1,83 @@
+package pudge
+
+import "hash/crc32"
+
+const mmapMin = 1 << 20 // min size of mapping of value file
+
+// mapValues map value file for reads if Config.Mmap, mapping reserved
+// ahead of file, so it grows rarely. Not used with segments. Caller must hold lock.
+// If mapping failed values read with ReadAt
+func (db *Db) mapValues(end int64) {
+	if !db.config.Mmap || db.storemode == 2 || db.segs != nil || db.fv == nil || end <= int64(len(db.mapped)) {
+		return
+	}
+	db.unmapValues()
+	size := 2 * end
+	if size < mmapMin {
+		size = mmapMin
+	}
+	if size != int64(int(size)) {
+		return
+	}
+	b, err := mmap(db.fv, int(size))
+	if err == nil {
+		db.mapped = b
+	}
+}
+
+// unmapValues drop mapping of value file, caller must hold lock
+func (db *Db) unmapValues() {
+	if db.mapped != nil {
+		munmap(db.mapped)
+		db.mapped = nil
+	}
+}
+
+// mappedVal return value from mapping of value file and verify checksum,
+// nil if value not mapped. Value valid while lock held
+func (db *Db) mappedVal(k []byte, cmd *Cmd) ([]byte, error) {
+	end := cmd.Seek + cmd.Size
+	if end > uint64(len(db.mapped)) {
+		return nil, nil
+	}
+	b := db.mapped[cmd.Seek:end:end]
+	if db.format >= formatV2 && crc32.Checksum(b, crcTable) != cmd.Checksum {
+		return nil, &ErrCorrupted{File: fileName(db.fv), Offset: int64(cmd.Seek), Key: k}
+	}
+	return b, nil
+}
+
+// ViewValue call fn with value of key
+// With Config.Mmap value is a view of mapped file without copy: it is valid
+// only during fn and must not be modified. Compressed or encrypted values
+// and values in other modes are passed decoded.
+// Return ErrKeyNotFound if key not exists, or error of fn
+func (db *Db) ViewValue(key interface{}, fn func([]byte) error) error {
+	db.RLock()
+	defer db.RUnlock()
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return err
+	}
+	cmd, ok := db.index.get(k)
+	if !ok || isExpired(cmd) {
+		if err = db.indexErr(); err != nil {
+			return err
+		}
+		return ErrKeyNotFound
+	}
+	if db.mapped != nil && cmd.Flags&(flagCompressed|flagEncrypted) == 0 {
+		b, err := db.mappedVal(k, cmd)
+		if err != nil {
+			return err
+		}
+		if b != nil {
+			return fn(b)
+		}
+	}
+	b, err := db.readValue(k, cmd)
+	if err != nil {
+		return err
+	}
+	return fn(b)
+}
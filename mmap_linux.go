@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package pudge
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap map size bytes of file for reading, size may exceed file size
+func mmap(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
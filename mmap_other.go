@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package pudge
+
+import "os"
+
+// mmap not supported, values read with ReadAt
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, nil
+}
+
+func munmap(b []byte) error {
+	return nil
+}
@@ -0,0 +1,281 @@
+package pudge
+
+import (
+	"bytes"
+	"sort"
+)
+
+const (
+	blockSize = 256     // max records in block of packed index
+	growStep  = 32      // capacity of block grows by steps, half empty blocks not allocated
+	chunkSize = 1 << 20 // max size of arena chunk with small keys
+	firstSize = 4096    // size of first arena chunk, next chunks doubles
+)
+
+// packedIndex keeps records sorted in blocks, blocks sorted by first key
+// one structure for lookup and ordered scan, no pointers and no
+// allocations per key: records packed in block arrays, keys in arena
+type packedIndex struct {
+	blocks []*block
+	arena  arena
+	length int
+}
+
+type block struct {
+	recs []packed
+}
+
+// packed - record of key without value, 56 bytes
+type packed struct {
+	seek     uint64
+	size     uint64
+	keySeek  uint64
+	version  uint64
+	checksum uint32
+	expire   uint32
+	key      keyRef
+	flags    uint8
+}
+
+// keyRef - position of key in arena
+type keyRef struct {
+	chunk uint32
+	off   uint32
+	size  uint32
+}
+
+// arena store keys one after another in big chunks
+// removed keys counted as dead and dropped on rebuild
+type arena struct {
+	chunks [][]byte
+	cur    int // chunk for small keys, -1 - none
+	small  int // count of chunks for small keys
+	live   int64
+	dead   int64
+}
+
+func newPackedIndex() *packedIndex {
+	return &packedIndex{arena: arena{cur: -1}}
+}
+
+// add copy key to arena
+func (a *arena) add(k []byte) keyRef {
+	a.live += int64(len(k))
+	if len(k) > chunkSize/16 {
+		// big key in own chunk
+		a.chunks = append(a.chunks, append([]byte(nil), k...))
+		return keyRef{chunk: uint32(len(a.chunks) - 1), size: uint32(len(k))}
+	}
+	if a.cur < 0 || len(a.chunks[a.cur])+len(k) > cap(a.chunks[a.cur]) {
+		size := chunkSize
+		if a.small < 8 {
+			size = firstSize << uint(a.small)
+		}
+		a.small++
+		a.chunks = append(a.chunks, make([]byte, 0, size))
+		a.cur = len(a.chunks) - 1
+	}
+	c := a.chunks[a.cur]
+	a.chunks[a.cur] = append(c, k...)
+	return keyRef{chunk: uint32(a.cur), off: uint32(len(c)), size: uint32(len(k))}
+}
+
+// key return key, capacity limited so append to key don't overwrite arena
+func (a *arena) key(r keyRef) []byte {
+	return a.chunks[r.chunk][r.off : r.off+r.size : r.off+r.size]
+}
+
+func (a *arena) free(r keyRef) {
+	a.live -= int64(r.size)
+	a.dead += int64(r.size)
+}
+
+func (r *packed) set(cmd *Cmd) {
+	r.seek, r.size, r.keySeek, r.version = cmd.Seek, cmd.Size, cmd.KeySeek, cmd.Version
+	r.checksum, r.expire, r.flags = cmd.Checksum, cmd.Expire, cmd.Flags
+}
+
+func (r *packed) get(cmd *Cmd) {
+	*cmd = Cmd{Seek: r.seek, Size: r.size, KeySeek: r.keySeek,
+		Checksum: r.checksum, Expire: r.expire, Flags: r.flags, Version: r.version}
+}
+
+// find return block and position in block of first key >= k
+// position may be equal to block length
+func (p *packedIndex) find(k []byte) (int, int) {
+	bi := sort.Search(len(p.blocks), func(i int) bool {
+		return bytes.Compare(p.arena.key(p.blocks[i].recs[0].key), k) > 0
+	}) - 1
+	if bi < 0 {
+		return 0, 0
+	}
+	recs := p.blocks[bi].recs
+	i := sort.Search(len(recs), func(i int) bool {
+		return bytes.Compare(p.arena.key(recs[i].key), k) >= 0
+	})
+	return bi, i
+}
+
+// lookup return record of key or nil
+func (p *packedIndex) lookup(k []byte) *packed {
+	bi, i := p.find(k)
+	if bi >= len(p.blocks) || i >= len(p.blocks[bi].recs) {
+		return nil
+	}
+	rec := &p.blocks[bi].recs[i]
+	if !bytes.Equal(p.arena.key(rec.key), k) {
+		return nil
+	}
+	return rec
+}
+
+func (p *packedIndex) get(k []byte) (*Cmd, bool) {
+	rec := p.lookup(k)
+	if rec == nil {
+		return nil, false
+	}
+	cmd := new(Cmd)
+	rec.get(cmd)
+	return cmd, true
+}
+
+func (p *packedIndex) put(k []byte, cmd *Cmd) {
+	if rec := p.lookup(k); rec != nil {
+		rec.set(cmd)
+		return
+	}
+	bi, i := p.find(k)
+	if len(p.blocks) == 0 {
+		p.blocks = append(p.blocks, &block{recs: make([]packed, 0, growStep)})
+	}
+	b := p.blocks[bi]
+	if len(b.recs) == blockSize {
+		// split full block, keys appended in order fill blocks completely
+		half := blockSize / 2
+		if bi == len(p.blocks)-1 && i == len(b.recs) {
+			half = blockSize
+		}
+		nb := &block{recs: reserve(nil, len(b.recs)-half+1)}
+		nb.recs = append(nb.recs, b.recs[half:]...)
+		if half < blockSize {
+			b.recs = append(reserve(nil, half+1), b.recs[:half]...)
+		}
+		p.blocks = append(p.blocks, nil)
+		copy(p.blocks[bi+2:], p.blocks[bi+1:])
+		p.blocks[bi+1] = nb
+		if i >= half {
+			b, i = nb, i-half
+		}
+	}
+	rec := packed{key: p.arena.add(k)}
+	rec.set(cmd)
+	b.recs = append(reserve(b.recs, 1), packed{})
+	copy(b.recs[i+1:], b.recs[i:])
+	b.recs[i] = rec
+	p.length++
+}
+
+func (p *packedIndex) remove(k []byte) {
+	rec := p.lookup(k)
+	if rec == nil {
+		return
+	}
+	bi, i := p.find(k)
+	b := p.blocks[bi]
+	p.arena.free(rec.key)
+	copy(b.recs[i:], b.recs[i+1:])
+	b.recs = b.recs[:len(b.recs)-1]
+	p.length--
+	p.merge(bi)
+	if p.arena.dead > p.arena.live && p.arena.dead > chunkSize {
+		p.rebuild()
+	}
+}
+
+// merge drop empty block or join small block with neighbour
+func (p *packedIndex) merge(bi int) {
+	b := p.blocks[bi]
+	if len(b.recs) >= blockSize/4 {
+		return
+	}
+	switch {
+	case len(b.recs) == 0:
+	case bi > 0 && len(p.blocks[bi-1].recs)+len(b.recs) <= blockSize*3/4:
+		p.blocks[bi-1].recs = append(reserve(p.blocks[bi-1].recs, len(b.recs)), b.recs...)
+	case bi < len(p.blocks)-1 && len(p.blocks[bi+1].recs)+len(b.recs) <= blockSize*3/4:
+		next := p.blocks[bi+1]
+		b.recs = append(reserve(b.recs, len(next.recs)), next.recs...)
+		bi++
+	default:
+		return
+	}
+	copy(p.blocks[bi:], p.blocks[bi+1:])
+	p.blocks[len(p.blocks)-1] = nil
+	p.blocks = p.blocks[:len(p.blocks)-1]
+}
+
+// reserve return recs with capacity for n more records,
+// capacity rounded up to growStep
+func reserve(recs []packed, n int) []packed {
+	if len(recs)+n <= cap(recs) {
+		return recs
+	}
+	size := (len(recs) + n + growStep - 1) / growStep * growStep
+	return append(make([]packed, 0, size), recs...)
+}
+
+// rebuild copy live keys in new arena
+func (p *packedIndex) rebuild() {
+	a := arena{cur: -1}
+	for _, b := range p.blocks {
+		for i := range b.recs {
+			b.recs[i].key = a.add(p.arena.key(b.recs[i].key))
+		}
+	}
+	p.arena = a
+}
+
+func (p *packedIndex) len() int {
+	return p.length
+}
+
+func (p *packedIndex) ascend(from []byte, fn func(k []byte, cmd *Cmd) bool) {
+	bi, i := 0, 0
+	if from != nil {
+		bi, i = p.find(from)
+	}
+	cmd := new(Cmd)
+	for ; bi < len(p.blocks); bi, i = bi+1, 0 {
+		recs := p.blocks[bi].recs
+		for ; i < len(recs); i++ {
+			recs[i].get(cmd)
+			if !fn(p.arena.key(recs[i].key), cmd) {
+				return
+			}
+		}
+	}
+}
+
+func (p *packedIndex) descend(before []byte, fn func(k []byte, cmd *Cmd) bool) {
+	bi, i := len(p.blocks)-1, 0
+	if bi >= 0 {
+		i = len(p.blocks[bi].recs)
+	}
+	if before != nil {
+		bi, i = p.find(before)
+	}
+	cmd := new(Cmd)
+	for bi >= 0 && bi < len(p.blocks) {
+		recs := p.blocks[bi].recs
+		for i--; i >= 0; i-- {
+			recs[i].get(cmd)
+			if !fn(p.arena.key(recs[i].key), cmd) {
+				return
+			}
+		}
+		bi--
+		if bi >= 0 {
+			i = len(p.blocks[bi].recs)
+		}
+	}
+}
@@ -3,13 +3,15 @@ package pudge
 import (
 	"bytes"
 	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
-	"sort"
 	"sync"
 	"time"
 )
@@ -17,31 +19,73 @@ import (
 var (
 	dbs struct {
 		sync.RWMutex
-		dbs map[string]*Db
+		dbs     map[string]*Db
+		opening map[string]chan struct{} // closed when Open of file finished
 	}
 	// ErrKeyNotFound - key not found
 	ErrKeyNotFound = errors.New("Error: key not found")
-	mutex          = &sync.RWMutex{}
+	// ErrTornTail - incomplete record at the end of index, see Config.Recovery
+	ErrTornTail = errors.New("Error: incomplete record at the end of index")
+	// ErrFormat - operation needs newer index format
+	ErrFormat = errors.New("Error: operation not supported by index format, run Compact to upgrade")
+	// ErrOverflow - offset or size not fit in legacy (version 0) index format
+	ErrOverflow = errors.New("Error: offset or size overflow legacy index format, run Compact to upgrade")
 )
 
 // Db represent database
+// Readers (Get, Has, Keys, Count...) hold read lock and never modify Db,
+// keys ordered on write
 type Db struct {
 	sync.RWMutex
 	name         string
 	fk           *os.File
 	fv           *os.File
-	keys         [][]byte
-	vals         map[string]*Cmd
+	index        index // keys with records, ordered
 	cancelSyncer context.CancelFunc
 	storemode    int
+	format       uint8 // index record version
+	config       Config
+	closed       bool
+	discarded    int64               // bytes of torn index tail and skipped records on open
+	garbage      int64               // dead bytes in value and index files
+	used         int64               // total bytes in value and index files
+	dirty        map[string]struct{} // keys changed while compaction in progress
+	compactMu    sync.Mutex
+	compactRun   int32
+	compactErr   error // error of last background compaction
+	groupMu      sync.Mutex
+	group        *syncGroup // writers waiting for group commit
+	holes        []hole     // free space in value file, sorted by size
+	pending      []hole     // free space, reusable after sync (AppendOnly)
+	expiring     int        // number of keys with expiration time
+	aead         cipher.AEAD
+	cache        *valueCache            // decoded values of hot keys, nil - no cache
+	mapped       []byte                 // mapping of value file (Config.Mmap), may exceed file
+	segs         map[uint32]*segment    // segments of value log, nil - one value file
+	seg          uint32                 // active segment, db.fv
+	batching     bool                   // batch in progress, see Write
+	deferred     []hole                 // space freed by batch, reusable after commit
+	snaps        map[*Snapshot]struct{} // open snapshots
+	held         []hole                 // space freed while snapshots open
+	version      uint64                 // highest version given to key, see SetIfVersion
+}
+
+// syncGroup represent writers waiting for one fsync
+type syncGroup struct {
+	done chan struct{}
+	err  error
 }
 
 // Cmd represent keys and vals addresses
 type Cmd struct {
-	Seek    uint32
-	Size    uint32
-	KeySeek uint32
-	Val     []byte
+	Seek     uint64
+	Size     uint64
+	KeySeek  uint64
+	Checksum uint32 // crc32c of value
+	Expire   uint32 // unix time of expiration, 0 - never
+	Flags    uint8  // value flags (compressed)
+	Version  uint64 // incremented by every set of key, from 1 (format v6)
+	Val      []byte
 }
 
 // Config fo db
@@ -49,15 +93,60 @@ type Cmd struct {
 // Default DirMode = 0755
 // Default SyncInterval = 0 sec, 0 - disable sync (os will sync, typically 30 sec or so)
 // If StroreMode==2 && file == "" - pure inmemory mode
+// Default CompactRatio = 0, 0 - disable background compaction
+// Default Recovery = 0, torn record at the end of index (after crash) will be truncated,
+// Recovery = 2 also skip damaged records inside index (lost keys counted in Discarded)
+// If AppendOnly - every key after crash has complete old or complete new value
+// Default SyncMode = SyncByInterval, CommitWindow = 10 ms
+// Default SweepInterval = 0 sec, 0 - expired keys removed only by Delete/Set
+// Default IndexMode = IndexMap, IndexPacked and IndexDisk ignored in memory first mode
+// Default MemtableKeys = 100000
+// If Checkpoint - index records always appended, Open load checkpoint and replay log tail
 type Config struct {
-	FileMode     int // 0644
-	DirMode      int // 0755
-	SyncInterval int // in seconds
-	StoreMode    int // 0 - file first, 2 - memory first(with persist on close), 2 - with empty file - memory without persist
+	FileMode      int     // 0644
+	DirMode       int     // 0755
+	SyncInterval  int     // in seconds
+	StoreMode     int     // 0 - file first, 2 - memory first(with persist on close), 2 - with empty file - memory without persist
+	CompactRatio  float64 // garbage/filesize ratio (0..1) which triggers background Compact
+	Recovery      int     // 0 - truncate torn index tail, 1 - refuse to open with ErrTornTail, 2 - truncate tail and skip damaged records
+	AppendOnly    bool    // never overwrite values and index records in place, sync value before index
+	SyncMode      int     // SyncByInterval, SyncEveryWrite or SyncGroupCommit
+	CommitWindow  int     // in milliseconds, writers in window share one fsync (SyncGroupCommit)
+	SweepInterval int     // in seconds, background removal of expired keys
+	Codec         Codec   // compress values if not nil
+	// AES key (16, 24 or 32 bytes), values encrypted with AES-GCM if set
+	EncryptionKey []byte
+	KeyProvider   KeyProvider // return encryption key, overrides EncryptionKey
+	EncryptKeys   bool        // encrypt keys in index file too
+	IndexMode     int         // IndexMap, IndexPacked or IndexDisk
+	MemtableKeys  int         // changed keys kept in memory before write to disk (IndexDisk)
+	// false positive rate (0..1) of bloom filters of run files, so lookups of
+	// missing keys don't read runs (IndexDisk), 0 - no filters
+	BloomFalsePositive float64
+	// bytes of decoded values cached in memory for Get (file first mode), 0 - no cache
+	CacheSize int64
+	Mmap      bool // read values from memory mapped value file (Linux, file first mode)
+	// max size of value segment, if set values appended to segment files
+	// name.seg<N>, see Compact and Backup. 0 - one value file
+	SegmentSize int64
+	Checkpoint  bool // write index checkpoint on Close and every CheckpointInterval
+	// in seconds, 0 - checkpoint on Close only
+	CheckpointInterval int
 }
 
+// Sync modes
+const (
+	// SyncByInterval - sync every SyncInterval seconds (if set)
+	SyncByInterval = 0
+	// SyncEveryWrite - Set and Delete return after fsync
+	SyncEveryWrite = 1
+	// SyncGroupCommit - Set and Delete return after fsync, shared by writers in CommitWindow
+	SyncGroupCommit = 2
+)
+
 func init() {
 	dbs.dbs = make(map[string]*Db)
+	dbs.opening = make(map[string]chan struct{})
 }
 
 func newDb(f string, cfg *Config) (*Db, error) {
@@ -69,9 +158,9 @@ func newDb(f string, cfg *Config) (*Db, error) {
 	defer db.Unlock()
 	// init
 	db.name = f
-	db.keys = make([][]byte, 0)
-	db.vals = make(map[string]*Cmd)
+	db.index = newIndex(cfg.IndexMode, cfg.StoreMode)
 	db.storemode = cfg.StoreMode
+	db.format = currentFormat
 
 	// Apply default values
 	if cfg.FileMode == 0 {
@@ -80,7 +169,19 @@ func newDb(f string, cfg *Config) (*Db, error) {
 	if cfg.DirMode == 0 {
 		cfg.DirMode = DefaultConfig.DirMode
 	}
+	if cfg.CommitWindow == 0 {
+		cfg.CommitWindow = DefaultConfig.CommitWindow
+	}
+	db.config = *cfg
+	if cfg.CacheSize > 0 && db.storemode != 2 {
+		db.cache = newValueCache(cfg.CacheSize)
+	}
+	db.aead, err = newAEAD(cfg)
+	if err != nil {
+		return nil, err
+	}
 	if db.storemode == 2 && db.name == "" {
+		db.backgroundManager(cfg.SyncInterval, cfg.SweepInterval, 0)
 		return db, nil
 	}
 	_, err = os.Stat(f)
@@ -97,6 +198,10 @@ func newDb(f string, cfg *Config) (*Db, error) {
 			return nil, err
 		}
 	}
+	err = recoverCompaction(f)
+	if err != nil {
+		return nil, err
+	}
 	db.fv, err = os.OpenFile(f, os.O_CREATE|os.O_RDWR, os.FileMode(cfg.FileMode))
 	if err != nil {
 		return nil, err
@@ -105,112 +210,564 @@ func newDb(f string, cfg *Config) (*Db, error) {
 	if err != nil {
 		return nil, err
 	}
-	//read keys
-	buf := new(bytes.Buffer)
-	b, err := ioutil.ReadAll(db.fk)
+	err = db.openSegments()
 	if err != nil {
+		db.fk.Close()
+		db.fv.Close()
 		return nil, err
 	}
-	buf.Write(b)
-	var readSeek uint32
-	for buf.Len() > 0 {
-		_ = uint8(buf.Next(1)[0]) //format version
-		t := uint8(buf.Next(1)[0])
-		seek := binary.BigEndian.Uint32(buf.Next(4))
-		size := binary.BigEndian.Uint32(buf.Next(4))
-		_ = buf.Next(4) //time
-		sizeKey := int(binary.BigEndian.Uint16(buf.Next(2)))
-		key := buf.Next(sizeKey)
-		strkey := string(key)
-		cmd := &Cmd{
-			Seek:    seek,
-			Size:    size,
-			KeySeek: readSeek,
+	if cfg.IndexMode == IndexDisk && db.storemode != 2 {
+		if cfg.EncryptKeys {
+			err = ErrIndexMode
+		} else {
+			db.index, err = openDiskIndex(f, db.fk, os.FileMode(cfg.FileMode), cfg.MemtableKeys, cfg.BloomFalsePositive)
+		}
+	}
+	var state runState
+	if d := db.diskIndex(); d != nil {
+		state = d.state
+	} else if err == nil {
+		// runs and checkpoint of other modes are stale after in place writes
+		removeRuns(f)
+		if cfg.Checkpoint && db.storemode != 2 {
+			state = db.loadCheckpoint()
+		} else {
+			os.Remove(f + checkpointSuffix)
+		}
+	}
+	if err == nil {
+		err = db.readIndex(state)
+	}
+	if err == nil && db.segs != nil {
+		err = db.removeDead()
+	}
+	if err == nil {
+		err = db.checkEncryption()
+	}
+	if err == nil {
+		var stat os.FileInfo
+		if stat, err = db.fv.Stat(); err == nil {
+			db.mapValues(stat.Size())
+		}
+	}
+	if err != nil {
+		if d := db.diskIndex(); d != nil {
+			d.close()
 		}
-		if db.storemode == 2 {
-			cmd.Val = make([]byte, size)
-			db.fv.ReadAt(cmd.Val, int64(seek))
+		db.closeSegments()
+		db.fk.Close()
+		db.fv.Close()
+		return nil, err
+	}
+
+	checkpointInterval := 0
+	if cfg.Checkpoint {
+		checkpointInterval = cfg.CheckpointInterval
+	}
+	db.backgroundManager(cfg.SyncInterval, cfg.SweepInterval, checkpointInterval)
+	return db, err
+}
+
+// readIndex read index file and fill keys
+// records before watermark of state already loaded from runs or checkpoint
+func (db *Db) readIndex(state runState) error {
+	d := db.diskIndex()
+	fkStat, err := db.fk.Stat()
+	if err != nil {
+		return err
+	}
+	db.used = fkStat.Size()
+	if db.used > 0 {
+		// keep format of existing file
+		var first [1]byte
+		_, err = db.fk.ReadAt(first[:], 0)
+		if err != nil {
+			return err
+		}
+		db.format = first[0]
+	}
+	_, err = db.fk.Seek(state.watermark, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	live := state.live
+	db.expiring = int(state.expiring)
+	db.version = state.version
+	// read by chunks, buffer grows for big records
+	b, pos, eof := make([]byte, 0, 1<<16), 0, false
+	fill := func() error {
+		n := copy(b[:cap(b)], b[pos:])
+		b, pos = b[:n], 0
+		if n == cap(b) {
+			b = append(make([]byte, 0, 2*cap(b)), b...)
+		}
+		m, err := db.fk.Read(b[n:cap(b)])
+		b = b[:n+m]
+		if err == io.EOF {
+			eof = true
+			return nil
+		}
+		return err
+	}
+	apply := func(t uint8, key []byte, cmd *Cmd) {
+		if old, exists := db.index.get(key); exists {
+			live -= int64(old.Size) + db.keyRecordSize(key)
+			if old.Expire != 0 {
+				db.expiring--
+			}
 		}
-		readSeek += uint32(16 + sizeKey)
 		switch t {
-		case 0:
-			if _, exists := db.vals[strkey]; !exists {
-				//write new key at keys store
-				db.appendKey(key)
+		case recSet:
+			db.index.put(key, cmd)
+			live += int64(cmd.Size) + db.keyRecordSize(key)
+			if cmd.Expire != 0 {
+				db.expiring++
 			}
-			db.vals[strkey] = cmd
-		case 1:
-			delete(db.vals, strkey)
-			db.deleteFromKeys(key)
+		case recDelete:
+			db.index.remove(key)
 		}
 	}
+	// records of batch applied on commit, batch without commit discarded
+	var batch []batchRec
+	batchSeek := int64(-1) // offset of begin marker of open batch
+	readSeek := uint64(state.watermark)
+	for {
+		if pos == len(b) && eof {
+			if batchSeek >= 0 {
+				// process died while batch was written
+				err = db.truncateTail(batchSeek)
+				if err != nil {
+					return err
+				}
+			}
+			break
+		}
+		rec, n, err := decodeRecord(b[pos:])
+		if err == nil && rec.format != db.format {
+			err, n = errBadRecord, 0
+		}
+		if err == errShortRecord && !eof && int64(readSeek)+int64(n) <= db.used {
+			// record fits in file, buffer grows to its size at most
+			err = fill()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err == errBadRecord {
+			zero, zerr := db.zeroTail(int64(readSeek))
+			if zerr != nil {
+				return zerr
+			}
+			if zero {
+				err = errShortRecord
+			}
+		}
+		if err == errShortRecord {
+			// process died while record was appended
+			tail := int64(readSeek)
+			if batchSeek >= 0 {
+				tail = batchSeek
+			}
+			err = db.truncateTail(tail)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if err == errBadRecord && n > 0 && db.config.Recovery == 2 {
+			// damaged record of known size skipped
+			db.discarded += int64(n)
+			readSeek += uint64(n)
+			pos += n
+			continue
+		}
+		if err != nil {
+			return &ErrCorrupted{File: fileName(db.fk), Offset: int64(readSeek), Key: rec.key}
+		}
+		if rec.version > db.version {
+			db.version = rec.version
+		}
+		key := rec.key
+		if rec.flags&flagKeyEncrypted != 0 {
+			key, err = db.open(key, nil)
+			if err != nil {
+				return err
+			}
+		}
+		cmd := &Cmd{
+			Seek:     rec.seek,
+			Size:     rec.size,
+			KeySeek:  readSeek,
+			Checksum: rec.checksum,
+			Expire:   rec.expire,
+			Flags:    rec.flags,
+			Version:  rec.version,
+		}
+		if db.storemode == 2 && rec.t == recSet {
+			cmd.Val, err = readVal(db.fv, db.format, cmd, key)
+			if err != nil {
+				return err
+			}
+		}
+		switch {
+		case rec.t == recBegin:
+			// open batch without commit was cut by write error
+			batch, batchSeek = batch[:0], int64(readSeek)
+		case rec.t == recCommit:
+			for _, r := range batch {
+				apply(r.t, r.key, r.cmd)
+			}
+			batch, batchSeek = batch[:0], -1
+		case batchSeek >= 0:
+			// key points to read buffer
+			batch = append(batch, batchRec{t: rec.t, key: append([]byte(nil), key...), cmd: cmd})
+		default:
+			apply(rec.t, key, cmd)
+		}
+		readSeek += uint64(n)
+		pos += n
+		if d != nil && d.full() && batchSeek < 0 {
+			fp, err := logPrint(db.fk, int64(readSeek))
+			if err == nil {
+				err = d.flush(runState{watermark: int64(readSeek), print: fp, live: live, expiring: int64(db.expiring)})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if db.segs != nil {
+		db.used += db.countSegments()
+		db.garbage = db.used - live
+		return nil
+	}
+	fvStat, err := db.fv.Stat()
+	if err != nil {
+		return err
+	}
+	db.used += fvStat.Size()
+	db.garbage = db.used - live
+	if db.storemode != 2 && d == nil {
+		db.buildHoles(uint64(fvStat.Size()))
+	}
+	return nil
+}
 
-	if cfg.SyncInterval > 0 {
-		db.backgroundManager(cfg.SyncInterval)
+// truncateTail discard torn index tail, started at offset
+// or return ErrTornTail if Config.Recovery disallow truncation
+func (db *Db) truncateTail(offset int64) error {
+	discarded := db.used - offset
+	if db.config.Recovery == 1 {
+		return fmt.Errorf("%w: %d bytes at offset %d", ErrTornTail, discarded, offset)
 	}
-	return db, err
+	err := db.fk.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	db.used = offset
+	db.discarded += discarded
+	return nil
+}
+
+// zeroTail return true if index file is zero from offset to end,
+// file read by chunks
+func (db *Db) zeroTail(offset int64) (bool, error) {
+	b := make([]byte, 1<<16)
+	for offset < db.used {
+		n, err := db.fk.ReadAt(b, offset)
+		if !isZero(b[:n]) {
+			return false, nil
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		offset += int64(n)
+	}
+	return true, nil
+}
+
+// isZero return true if all bytes are zero
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 // backgroundManager runs continuously in the background and performs various
-// operations such as syncing to disk.
-func (db *Db) backgroundManager(interval int) {
+// operations such as syncing to disk, removing expired keys and index checkpoints.
+// Intervals in seconds, 0 - disable operation
+func (db *Db) backgroundManager(syncInterval, sweepInterval, checkpointInterval int) {
+	if syncInterval <= 0 && sweepInterval <= 0 && checkpointInterval <= 0 {
+		return
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	db.cancelSyncer = cancel
+	var tickers []*time.Ticker
+	tick := func(interval int) <-chan time.Time {
+		if interval <= 0 {
+			return nil
+		}
+		t := time.NewTicker(time.Duration(interval) * time.Second)
+		tickers = append(tickers, t)
+		return t.C
+	}
+	syncTick, sweepTick, checkpointTick := tick(syncInterval), tick(sweepInterval), tick(checkpointInterval)
 	go func() {
+		defer func() {
+			for _, t := range tickers {
+				t.Stop()
+			}
+		}()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			default:
-				db.Lock()
-				db.fk.Sync()
-				db.fv.Sync()
-				db.Unlock()
-				time.Sleep(time.Duration(interval) * time.Second)
+			case <-syncTick:
+				db.Sync()
+			case <-sweepTick:
+				db.sweep()
+			case <-checkpointTick:
+				db.Checkpoint()
 			}
 		}
 	}()
 }
 
-//appendKey insert key in slice
-func (db *Db) appendKey(b []byte) {
-	//log.Println("append")
-	db.keys = append(db.keys, b)
-	return
+// sweep delete expired keys, closed db not touched
+func (db *Db) sweep() {
+	db.Lock()
+	defer db.Unlock()
+	if db.closed || db.expiring == 0 {
+		return
+	}
+	now := uint32(time.Now().Unix())
+	var keys [][]byte
+	db.index.ascend(nil, func(k []byte, cmd *Cmd) bool {
+		if cmd.Expire != 0 && cmd.Expire <= now {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	for _, k := range keys {
+		db.delete(k)
+	}
+}
+
+// expired return true if key has expired, caller must hold lock
+func (db *Db) expired(k []byte) bool {
+	if db.expiring == 0 {
+		return false
+	}
+	cmd, ok := db.index.get(k)
+	return ok && isExpired(cmd)
+}
+
+func isExpired(cmd *Cmd) bool {
+	return cmd.Expire != 0 && cmd.Expire <= uint32(time.Now().Unix())
 }
 
-// deleteFromKeys delete key from slice keys
-func (db *Db) deleteFromKeys(b []byte) {
-	found := db.found(b, true)
-	if found < len(db.keys) {
-		if bytes.Equal(db.keys[found], b) {
-			db.keys = append(db.keys[:found], db.keys[found+1:]...)
+// set store key and value with expiration time (0 - never),
+// caller must hold lock
+func (db *Db) set(k, v []byte, expire uint32) error {
+	return db.setValue(k, v, expire, 0)
+}
+
+// setValue store key and value with value flags kind (counters),
+// caller must hold lock
+func (db *Db) setValue(k, v []byte, expire uint32, kind uint8) error {
+	//log.Println("Set:", k, v)
+	if expire != 0 && db.format < formatV3 {
+		return ErrFormat
+	}
+	if size := db.keySize(k); size > maxKeySize(db.format) {
+		return &ErrKeyTooLong{Size: size, Max: maxKeySize(db.format)}
+	}
+	oldCmd, exists := db.index.get(k)
+	if err := db.indexErr(); err != nil {
+		return err
+	}
+	if db.cache != nil {
+		db.cache.remove(k)
+	}
+	if exists && oldCmd.Expire != 0 {
+		db.expiring--
+	}
+	if expire != 0 {
+		db.expiring++
+	}
+	v, flags, err := db.encodeVal(k, v)
+	if err != nil {
+		return err
+	}
+	flags |= kind
+	var version uint64
+	if db.format >= formatV6 {
+		// key created again never get version of deleted key
+		version = db.version + 1
+		if exists {
+			version = oldCmd.Version + 1
+		}
+		if version > db.version {
+			db.version = version
+		}
+	}
+	//fmt.Println("StoreMode", db.config.StoreMode)
+	if db.storemode == 2 {
+		cmd := &Cmd{Expire: expire, Flags: flags, Version: version}
+		cmd.Size = uint64(len(v))
+		cmd.Val = make([]byte, len(v))
+		copy(cmd.Val, v)
+		db.preserve(k, oldCmd)
+		db.index.put(k, cmd)
+	} else {
+		seek, keySeek := int64(-1), int64(-1)
+		if exists && !db.config.AppendOnly && !db.batching {
+			// update in place, runs and checkpoint need appended records
+			if !db.appendIndex() {
+				keySeek = int64(oldCmd.KeySeek)
+			}
+			// running compaction read old values without lock
+			if oldCmd.Size >= uint64(len(v)) && len(db.snaps) == 0 && db.dirty == nil {
+				seek = int64(oldCmd.Seek)
+			}
+		}
+		if seek < 0 && db.dirty == nil {
+			seek = db.allocHole(uint64(len(v)))
+		}
+		cmd := &Cmd{Expire: expire, Flags: flags, Version: version}
+		sealed, err := db.sealKey(k, cmd)
+		if err != nil {
+			return err
 		}
+		if db.segs != nil {
+			err = db.writeSegment(sealed, v, cmd, keySeek)
+		} else {
+			err = writeKeyVal(db.fk, db.fv, db.format, sealed, v, cmd, seek, keySeek, db.config.AppendOnly)
+		}
+		if err != nil {
+			return err
+		}
+		db.preserve(k, oldCmd)
+		db.index.put(k, cmd)
+		db.track(k, oldCmd, cmd)
+		db.mapValues(int64(cmd.Seek + cmd.Size))
 	}
+	return db.flushIndex()
 }
 
-func (db *Db) sort() {
-	if !sort.SliceIsSorted(db.keys, db.lessBinary) {
-		//log.Println("sort")
-		sort.Slice(db.keys, db.lessBinary)
+// delete remove key, caller must hold lock
+func (db *Db) delete(k []byte) error {
+	oldCmd, ok := db.index.get(k)
+	if !ok {
+		if err := db.indexErr(); err != nil {
+			return err
+		}
+		return ErrKeyNotFound
 	}
+	if db.fk != nil {
+		// key stay if tombstone not written
+		tomb := &Cmd{Version: db.version}
+		sealed, err := db.sealKey(k, tomb)
+		if err != nil {
+			return err
+		}
+		_, err = writeKey(db.fk, db.format, 1, tomb, sealed, -1)
+		if err != nil {
+			return err
+		}
+	}
+	db.preserve(k, oldCmd)
+	db.index.remove(k)
+	if db.cache != nil {
+		db.cache.remove(k)
+	}
+	if oldCmd.Expire != 0 {
+		db.expiring--
+	}
+	if db.storemode != 2 {
+		db.track(k, oldCmd, nil)
+	}
+	return db.flushIndex()
 }
 
-func (db *Db) lessBinary(i, j int) bool {
-	return bytes.Compare(db.keys[i], db.keys[j]) <= 0
+// commit sync write to disk according to Config.SyncMode
+// must be called without lock
+func (db *Db) commit() error {
+	if db.storemode == 2 {
+		return nil
+	}
+	switch db.config.SyncMode {
+	case SyncEveryWrite:
+		return db.Sync()
+	case SyncGroupCommit:
+		return db.groupSync()
+	}
+	return nil
 }
 
-//found return binary search result with sort order
-func (db *Db) found(b []byte, asc bool) int {
-	db.sort()
-	//if asc {
-	return sort.Search(len(db.keys), func(i int) bool {
-		return bytes.Compare(db.keys[i], b) >= 0
-	})
-	//}
-	//return sort.Search(len(db.keys), func(i int) bool {
-	//	return bytes.Compare(db.keys[i], b) <= 0
-	//})
+// groupSync wait for fsync, shared by all writers,
+// joined to group in Config.CommitWindow
+func (db *Db) groupSync() error {
+	db.groupMu.Lock()
+	g := db.group
+	if g == nil {
+		g = &syncGroup{done: make(chan struct{})}
+		db.group = g
+		window := time.Duration(db.config.CommitWindow) * time.Millisecond
+		time.AfterFunc(window, func() {
+			db.groupMu.Lock()
+			db.group = nil
+			db.groupMu.Unlock()
+			g.err = db.Sync()
+			close(g.done)
+		})
+	}
+	db.groupMu.Unlock()
+	<-g.done
+	return g.err
+}
+
+// track updates garbage statistic and free space after key k changed
+// from oldCmd to cmd (nil oldCmd - new key, nil cmd - deleted key)
+// and marks key as dirty for running compaction
+func (db *Db) track(k []byte, oldCmd, cmd *Cmd) {
+	if db.dirty != nil {
+		db.dirty[string(k)] = struct{}{}
+	}
+	if db.segs != nil {
+		db.trackSegment(oldCmd, -1)
+		db.trackSegment(cmd, 1)
+	}
+	rec := db.keyRecordSize(k)
+	switch {
+	case oldCmd == nil:
+		db.used += int64(cmd.Size) + rec
+	case cmd == nil:
+		db.used += rec
+		db.garbage += int64(oldCmd.Size) + 2*rec
+		db.freeHole(oldCmd.Seek, oldCmd.Size)
+	case cmd.Seek == oldCmd.Seek && cmd.Size <= oldCmd.Size:
+		// value rewritten in place, empty value at end of file may be moved with same seek
+		db.garbage += int64(oldCmd.Size) - int64(cmd.Size)
+		db.freeHole(cmd.Seek+cmd.Size, oldCmd.Size-cmd.Size)
+	default:
+		db.used += int64(cmd.Size)
+		db.garbage += int64(oldCmd.Size)
+		db.freeHole(oldCmd.Seek, oldCmd.Size)
+	}
+	if oldCmd != nil && cmd != nil && cmd.KeySeek != oldCmd.KeySeek {
+		// index record appended
+		db.used += rec
+		db.garbage += rec
+	}
+	db.maybeCompact()
 }
 
 // KeyToBinary return key in bytes
@@ -261,38 +818,26 @@ func ValToBinary(v interface{}) ([]byte, error) {
 	}
 }
 
-func writeKeyVal(fk, fv *os.File, readKey, writeVal []byte, exists bool, oldCmd *Cmd) (cmd *Cmd, err error) {
-
-	var seek, newSeek int64
-	cmd = &Cmd{Size: uint32(len(writeVal))}
-	if exists {
-		// key exists
-		cmd.Seek = oldCmd.Seek
-		cmd.KeySeek = oldCmd.KeySeek
-		if oldCmd.Size >= uint32(len(writeVal)) {
-			//write at old seek new value
-			_, _, err = writeAtPos(fv, writeVal, int64(oldCmd.Seek))
-		} else {
-			//write at new seek (at the end of file)
-			seek, _, err = writeAtPos(fv, writeVal, int64(-1))
-			cmd.Seek = uint32(seek)
-		}
-		if err == nil {
-			// if no error - store key at KeySeek
-			newSeek, err = writeKey(fk, 0, cmd.Seek, cmd.Size, []byte(readKey), int64(cmd.KeySeek))
-			cmd.KeySeek = uint32(newSeek)
-		}
-	} else {
-		// new key
-		// write value at the end of file
-		seek, _, err = writeAtPos(fv, writeVal, int64(-1))
-		cmd.Seek = uint32(seek)
-		if err == nil {
-			newSeek, err = writeKey(fk, 0, cmd.Seek, cmd.Size, []byte(readKey), -1)
-			cmd.KeySeek = uint32(newSeek)
+// writeKeyVal store value at seek and key record at keySeek and fill cmd
+// if seek or keySeek < 0 - store at the end of file
+// if barrier is true, value synced to disk before key is written
+func writeKeyVal(fk, fv *os.File, format uint8, readKey, writeVal []byte, cmd *Cmd, seek, keySeek int64, barrier bool) (err error) {
+	cmd.Size = uint64(len(writeVal))
+	cmd.Checksum = crc32.Checksum(writeVal, crcTable)
+	seek, _, err = writeAtPos(fv, writeVal, seek)
+	if err != nil {
+		return err
+	}
+	cmd.Seek = uint64(seek)
+	if barrier {
+		err = fv.Sync()
+		if err != nil {
+			return err
 		}
 	}
-	return cmd, err
+	keySeek, err = writeKey(fk, format, 0, cmd, readKey, keySeek)
+	cmd.KeySeek = uint64(keySeek)
+	return err
 }
 
 // if pos<0 store at the end of file
@@ -311,56 +856,69 @@ func writeAtPos(f *os.File, b []byte, pos int64) (seek int64, n int, err error)
 	return seek, n, err
 }
 
-// writeKey create buffer and store key with val address and size
-func writeKey(fk *os.File, t uint8, seek, size uint32, key []byte, keySeek int64) (newSeek int64, err error) {
-	//get buf from pool
-	buf := new(bytes.Buffer)
-	buf.Reset()
-	buf.Grow(16 + len(key))
-
-	//encode
-	binary.Write(buf, binary.BigEndian, uint8(0))                  //1byte version
-	binary.Write(buf, binary.BigEndian, t)                         //1byte command code(0-set,1-delete)
-	binary.Write(buf, binary.BigEndian, seek)                      //4byte seek
-	binary.Write(buf, binary.BigEndian, size)                      //4byte size
-	binary.Write(buf, binary.BigEndian, uint32(time.Now().Unix())) //4byte timestamp
-	binary.Write(buf, binary.BigEndian, uint16(len(key)))          //2byte key size
-	buf.Write(key)                                                 //key
-
-	if keySeek < 0 {
-		newSeek, _, err = writeAtPos(fk, buf.Bytes(), int64(-1))
-	} else {
-		newSeek, _, err = writeAtPos(fk, buf.Bytes(), int64(keySeek))
+// readValue return decoded value of key, caller must hold lock
+func (db *Db) readValue(k []byte, cmd *Cmd) (b []byte, err error) {
+	if db.cache != nil {
+		if b, ok := db.cache.get(k); ok {
+			return b, nil
+		}
 	}
-
-	return newSeek, err
+	b, err = db.loadValue(k, cmd)
+	if err == nil && db.cache != nil {
+		db.cache.add(k, b)
+	}
+	return b, err
 }
 
-// findKey return index of first key in ascending mode
-// findKey return index of last key in descending mode
-// findKey return 0 or len-1 in case of nil key
-func (db *Db) findKey(key interface{}, asc bool) (int, error) {
-	if key == nil {
-		db.sort()
-		if asc {
-			return 0, ErrKeyNotFound
+// loadValue read and decode value of cmd bypassing cache
+func (db *Db) loadValue(k []byte, cmd *Cmd) (b []byte, err error) {
+	if db.storemode == 2 {
+		b = make([]byte, cmd.Size)
+		copy(b, cmd.Val)
+		return db.decodeVal(k, b, cmd.Flags)
+	}
+	if db.mapped != nil {
+		b, err = db.mappedVal(k, cmd)
+		if b != nil {
+			b = append([]byte(nil), b...)
 		}
-		return len(db.keys) - 1, ErrKeyNotFound
 	}
-	k, err := KeyToBinary(key)
+	if b == nil && err == nil {
+		b, err = db.readStored(k, cmd)
+	}
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
-	found := db.found(k, asc)
-	//log.Println("found", found)
-	// check found
-	if found >= len(db.keys) {
-		return -1, ErrKeyNotFound
+	return db.decodeVal(k, b, cmd.Flags)
+}
+
+// readVal read value of key from file and verify checksum
+func readVal(f *os.File, format uint8, cmd *Cmd, key []byte) ([]byte, error) {
+	b := make([]byte, cmd.Size)
+	_, err := f.ReadAt(b, int64(cmd.Seek))
+	if err != nil {
+		return nil, err
+	}
+	if format >= formatV2 && crc32.Checksum(b, crcTable) != cmd.Checksum {
+		return nil, &ErrCorrupted{File: fileName(f), Offset: int64(cmd.Seek), Key: key}
+	}
+	return b, nil
+}
+
+// writeKey store key with val address and size
+// in index record of given format
+func writeKey(fk *os.File, format uint8, t uint8, cmd *Cmd, key []byte, keySeek int64) (newSeek int64, err error) {
+	b, err := encodeRecord(format, t, cmd, key)
+	if err != nil {
+		return -1, err
 	}
-	if !bytes.Equal(db.keys[found], k) {
-		return -1, ErrKeyNotFound
+	if keySeek < 0 {
+		newSeek, _, err = writeAtPos(fk, b, int64(-1))
+	} else {
+		newSeek, _, err = writeAtPos(fk, b, int64(keySeek))
 	}
-	return found, nil
+
+	return newSeek, err
 }
 
 // startFrom return is a start from b in binary
@@ -374,48 +932,50 @@ func startFrom(a, b []byte) bool {
 	return bytes.Compare(a[:len(b)], b) == 0
 }
 
-func (db *Db) foundPref(b []byte, asc bool) int {
-	db.sort()
+// prefixStart return key to start walk over keys with prefix b:
+// prefix in ascending order, prefix with incremented last byte in descending order
+// nil - walk from last key
+func prefixStart(b []byte, asc bool) []byte {
 	if asc {
-		return sort.Search(len(db.keys), func(i int) bool {
-			return bytes.Compare(db.keys[i], b) >= 0
-		})
+		return b
 	}
-	var j int
-	for j = len(db.keys) - 1; j >= 0; j-- {
-		if startFrom(db.keys[j], b) {
-			break
+	upper := make([]byte, len(b))
+	copy(upper, b)
+	for i := len(upper) - 1; i >= 0; i-- {
+		upper[i]++
+		if upper[i] != 0 {
+			return upper[:i+1]
 		}
 	}
-	return j
+	return nil
 }
 
-func checkInterval(find, limit, offset, excludeFrom, len int, asc bool) (int, int) {
-	end := 0
-	start := find
-
-	if asc {
-		start += (offset + excludeFrom)
-		if limit == 0 {
-			end = len - excludeFrom
-		} else {
-			end = (start + limit - 1)
+// collectKeys walk keys from key in given order while match return true,
+// skip expired and offset keys, return up to limit keys (0 - all)
+// ascending walk start from first key >= from, descending - from last key < from,
+// nil from - from first or last key
+// found is false if no key matched
+func (db *Db) collectKeys(from []byte, limit, offset int, asc bool, match func([]byte) bool) (arr [][]byte, found bool) {
+	arr = make([][]byte, 0, 0)
+	fn := func(k []byte, cmd *Cmd) bool {
+		if match != nil && !match(k) {
+			return false
 		}
-	} else {
-		start -= (offset + excludeFrom)
-		if limit == 0 {
-			end = 0
-		} else {
-			end = start - limit + 1
+		found = true
+		if db.expiring > 0 && isExpired(cmd) {
+			return true
 		}
+		if offset > 0 {
+			offset--
+			return true
+		}
+		arr = append(arr, k)
+		return limit == 0 || len(arr) < limit
 	}
-
-	if end < 0 {
-		end = 0
-	}
-	if end >= len {
-		end = len - 1
+	if asc {
+		db.index.ascend(from, fn)
+	} else {
+		db.index.descend(from, fn)
 	}
-
-	return start, end
+	return arr, found
 }
@@ -1,9 +1,18 @@
 package pudge
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"testing"
@@ -498,10 +507,15 @@ func TestMultipleOpen(t *testing.T) {
 		Set("test/m", i, i)
 	}
 	Close("test/m")
+	var wg sync.WaitGroup
 	for i := 1; i < 100; i++ {
-		go Open("test/m", nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Open("test/m", nil)
+		}()
 	}
-	time.Sleep(1 * time.Millisecond)
+	wg.Wait()
 	DeleteFile("test/m")
 }
 
@@ -747,3 +761,2191 @@ func TestEmptyKeysByPrefix(t *testing.T) {
 	}
 
 }
+
+func TestCompact(t *testing.T) {
+	f := "test/compact"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		for j := 1; j <= 10; j++ {
+			db.Set(i, make([]byte, i*j))
+		}
+	}
+	for i := 0; i < 50; i++ {
+		db.Delete(i)
+	}
+	before, _ := db.FileSize()
+	err = db.Compact()
+	if err != nil {
+		t.Error(err)
+	}
+	after, _ := db.FileSize()
+	if after >= before {
+		t.Error("file not shrinked", before, after)
+	}
+	check := func() {
+		cnt, _ := db.Count()
+		if cnt != 50 {
+			t.Error("count must be 50", cnt)
+		}
+		for i := 50; i < 100; i++ {
+			var v []byte
+			err := db.Get(i, &v)
+			if err != nil || len(v) != i*10 {
+				t.Error("wrong val", i, len(v), err)
+			}
+		}
+	}
+	check()
+	db.Close()
+	db, err = Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	db.DeleteFile()
+}
+
+func TestCompactConcurrent(t *testing.T) {
+	f := "test/compactasync"
+	DeleteFile(f)
+	db, err := Open(f, &Config{CompactRatio: 0.3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("%d:%d", g, i%100)
+				err := db.Set(key, make([]byte, i))
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	size, _ := db.FileSize()
+	if size > 4*2000*2000/2 {
+		t.Error("background compaction not run", size)
+	}
+	err = db.Compact()
+	if err != nil {
+		t.Error(err)
+	}
+	db.Close()
+	db, err = Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for g := 0; g < 4; g++ {
+		for i := 1900; i < 2000; i++ {
+			var v []byte
+			err := db.Get(fmt.Sprintf("%d:%d", g, i%100), &v)
+			if err != nil || len(v) != i {
+				t.Error("wrong val", g, i, len(v), err)
+			}
+		}
+	}
+	db.DeleteFile()
+}
+
+func TestLegacyFormat(t *testing.T) {
+	f := "test/legacy"
+	DeleteFile(f)
+	os.MkdirAll("test", 0755)
+	// version 0 file: 4byte seek and size
+	val, _ := ValToBinary(42)
+	idx := new(bytes.Buffer)
+	binary.Write(idx, binary.BigEndian, uint8(0))
+	binary.Write(idx, binary.BigEndian, uint8(0))
+	binary.Write(idx, binary.BigEndian, uint32(0))
+	binary.Write(idx, binary.BigEndian, uint32(len(val)))
+	binary.Write(idx, binary.BigEndian, uint32(time.Now().Unix()))
+	binary.Write(idx, binary.BigEndian, uint16(3))
+	idx.WriteString("key")
+	ioutil.WriteFile(f, val, 0644)
+	ioutil.WriteFile(f+".idx", idx.Bytes(), 0644)
+
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	err = db.Get("key", &v)
+	if err != nil || v != 42 {
+		t.Error("legacy read", v, err)
+	}
+	db.Set("key2", 43)
+	if db.format != formatV0 {
+		t.Error("legacy format must be kept", db.format)
+	}
+	db.Close()
+	db, _ = Open(f, nil)
+	db.Get("key2", &v)
+	if v != 43 {
+		t.Error("legacy write", v)
+	}
+	err = db.Compact()
+	if err != nil || db.format != currentFormat {
+		t.Error("compact must upgrade format", db.format, err)
+	}
+	db.Close()
+	db, _ = Open(f, nil)
+	db.Get("key", &v)
+	if v != 42 || db.format != currentFormat {
+		t.Error("upgraded read", v, db.format)
+	}
+	db.DeleteFile()
+
+	_, err = writeKey(nil, formatV0, 0, &Cmd{Seek: math.MaxUint32, Size: 2}, []byte("key"), -1)
+	if err != ErrOverflow {
+		t.Error("must overflow", err)
+	}
+}
+
+func TestCorrupted(t *testing.T) {
+	f := "test/corrupted"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("key1", "val1")
+	db.Set("key2", "val2")
+	db.Close()
+
+	// bit flip in value
+	fv, _ := os.OpenFile(f, os.O_RDWR, 0644)
+	fv.WriteAt([]byte{0xff}, 6)
+	fv.Close()
+	db, err = Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	err = db.Get("key1", &v)
+	if e, ok := err.(*ErrCorrupted); !ok || string(e.Key) != "key1" || e.Offset != 0 {
+		t.Error("value must be corrupted", err)
+	}
+	err = db.Get("key2", &v)
+	if err != nil || v != "val2" {
+		t.Error("key2 must be readable", v, err)
+	}
+	db.Close()
+
+	// bit flip in second index record
+	fk, _ := os.OpenFile(f+".idx", os.O_RDWR, 0644)
+	offset := recordSize(currentFormat, []byte("key1"))
+	fk.WriteAt([]byte{0xff}, offset+5)
+	fk.Close()
+	_, err = Open(f, nil)
+	if e, ok := err.(*ErrCorrupted); !ok || e.Offset != offset {
+		t.Error("index must be corrupted", err)
+	}
+	// damaged record inside index skipped
+	fk, _ = os.OpenFile(f+".idx", os.O_RDWR|os.O_APPEND, 0644)
+	b := make([]byte, offset)
+	fk.ReadAt(b, 0)
+	fk.Write(b)
+	fk.Close()
+	_, err = Open(f, nil)
+	if e, ok := err.(*ErrCorrupted); !ok || e.Offset != offset {
+		t.Error("index must be corrupted", err)
+	}
+	db, err = Open(f, &Config{Recovery: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Discarded() != offset {
+		t.Error("discarded", db.Discarded(), offset)
+	}
+	if ok, _ := db.Has("key1"); !ok {
+		t.Error("key1 must be loaded")
+	}
+	if err = db.Get("key2", &v); err != ErrKeyNotFound {
+		t.Error("key2 must be skipped", err)
+	}
+	db.Close()
+	os.Remove(f)
+	os.Remove(f + ".idx")
+}
+
+func TestTornTail(t *testing.T) {
+	f := "test/torn"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("key1", "val1")
+	db.Set("key2", "val2")
+	db.Close()
+	size := recordSize(currentFormat, []byte("key1")) * 2
+
+	for _, tail := range [][]byte{{currentFormat, 0, 0, 0}, make([]byte, 40)} {
+		fk, _ := os.OpenFile(f+".idx", os.O_RDWR|os.O_APPEND, 0644)
+		fk.Write(tail)
+		fk.Close()
+
+		_, err = Open(f, &Config{Recovery: 1})
+		if !errors.Is(err, ErrTornTail) {
+			t.Error("must refuse torn tail", err)
+		}
+		db, err = Open(f, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.Discarded() != int64(len(tail)) {
+			t.Error("discarded", db.Discarded(), len(tail))
+		}
+		var v string
+		err = db.Get("key2", &v)
+		if err != nil || v != "val2" {
+			t.Error("key2 must be readable", v, err)
+		}
+		db.Close()
+		fi, _ := os.Stat(f + ".idx")
+		if fi.Size() != size {
+			t.Error("tail not truncated", fi.Size(), size)
+		}
+	}
+	DeleteFile(f)
+}
+
+func TestAppendOnly(t *testing.T) {
+	f := "test/appendonly"
+	DeleteFile(f)
+	cfg := &Config{AppendOnly: true}
+	db, err := Open(f, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("key", "old value")
+	db.Close()
+	idx, _ := os.Stat(f + ".idx")
+
+	db, _ = Open(f, cfg)
+	db.Set("key", "new")
+	var v string
+	db.Get("key", &v)
+	if v != "new" {
+		t.Error("not new", v)
+	}
+	db.Close()
+	db, _ = Open(f, cfg)
+	db.Get("key", &v)
+	if v != "new" {
+		t.Error("not new after reopen", v)
+	}
+	db.Close()
+
+	// crash before index record written - old value must survive
+	os.Truncate(f+".idx", idx.Size())
+	db, _ = Open(f, cfg)
+	err = db.Get("key", &v)
+	if err != nil || v != "old value" {
+		t.Error("old value must survive", v, err)
+	}
+	db.DeleteFile()
+}
+
+func TestSyncMode(t *testing.T) {
+	for _, mode := range []int{SyncEveryWrite, SyncGroupCommit} {
+		f := "test/syncmode"
+		DeleteFile(f)
+		db, err := Open(f, &Config{SyncMode: mode, CommitWindow: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := db.Set(i, i)
+				if err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		err = db.Delete(1)
+		if err != nil {
+			t.Error(err)
+		}
+		err = db.Sync()
+		if err != nil {
+			t.Error(err)
+		}
+		cnt, _ := db.Count()
+		if cnt != 49 {
+			t.Error("count must be 49", cnt)
+		}
+		db.DeleteFile()
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	f := "test/freespace"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val := func(i, size int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, size)
+	}
+	for i := 0; i < 100; i++ {
+		db.Set(i, val(i, 100))
+	}
+	valSize := func() int64 {
+		fi, _ := os.Stat(f)
+		return fi.Size()
+	}
+	size := valSize()
+	for i := 0; i < 100; i += 2 {
+		db.Delete(i)
+	}
+	for i := 100; i < 150; i++ {
+		db.Set(i, val(i, 90))
+	}
+	if valSize() != size {
+		t.Error("deleted space not reused", valSize(), size)
+	}
+	db.Close()
+
+	// free list rebuilt on open
+	db, _ = Open(f, nil)
+	for i := 150; i < 200; i++ {
+		db.Set(i, val(i, 10))
+	}
+	if valSize() != size {
+		t.Error("free space not rebuilt", valSize(), size)
+	}
+	for i := 1; i < 200; i += 2 {
+		if i > 100 && i < 150 {
+			continue
+		}
+		var v []byte
+		db.Get(i, &v)
+		expected := 100
+		if i >= 150 {
+			expected = 10
+		}
+		if !bytes.Equal(v, val(i, expected)) {
+			t.Error("wrong value", i, len(v))
+		}
+	}
+	db.DeleteFile()
+}
+
+func TestTTL(t *testing.T) {
+	f := "test/ttl"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetWithTTL("live", 1, time.Hour)
+	if err != nil {
+		t.Error(err)
+	}
+	db.Set("forever", 2)
+	ttl, err := db.TTL("live")
+	if err != nil || ttl <= 59*time.Minute || ttl > time.Hour+time.Second {
+		t.Error("wrong ttl", ttl, err)
+	}
+	ttl, err = db.TTL("forever")
+	if err != nil || ttl != 0 {
+		t.Error("must be without ttl", ttl, err)
+	}
+	// expired keys
+	past := uint32(time.Now().Unix() - 1)
+	for i := 0; i < 5; i++ {
+		db.Lock()
+		db.set([]byte(fmt.Sprintf("expired%d", i)), []byte("v"), past)
+		db.Unlock()
+	}
+	db.SetWithTTL("expired5", 1, -1)
+	if has, _ := db.Has("expired5"); has {
+		t.Error("key with negative ttl must be absent")
+	}
+	if cnt, _ := db.Count(); cnt != 2 {
+		t.Error("expired keys counted", cnt)
+	}
+	var v int
+	if err = db.Get("expired1", &v); err != ErrKeyNotFound {
+		t.Error("expired key must be not found", err)
+	}
+	if has, _ := db.Has("expired1"); has {
+		t.Error("expired key must be absent")
+	}
+	if _, err = db.TTL("expired1"); err != ErrKeyNotFound {
+		t.Error("expired key ttl", err)
+	}
+	keys, _ := db.Keys(nil, 2, 0, true)
+	if len(keys) != 2 || string(keys[0]) != "forever" || string(keys[1]) != "live" {
+		t.Error("expired keys in Keys", len(keys))
+	}
+	keys, _ = db.Keys([]byte("exp*"), 0, 0, true)
+	if len(keys) != 0 {
+		t.Error("expired keys in prefix", len(keys))
+	}
+	db.sweep()
+	cnt, _ := db.Count()
+	if cnt != 2 {
+		t.Error("expired keys not swept", cnt)
+	}
+	db.Close()
+	db, _ = Open(f, nil)
+	cnt, _ = db.Count()
+	if cnt != 2 {
+		t.Error("expired keys must be deleted after restart", cnt)
+	}
+	ttl, _ = db.TTL("live")
+	if ttl <= 59*time.Minute {
+		t.Error("ttl not persisted", ttl)
+	}
+	db.DeleteFile()
+}
+
+func TestCompression(t *testing.T) {
+	f := "test/compression"
+	DeleteFile(f)
+	// old values without compression
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := bytes.Repeat([]byte("pudge "), 1000)
+	db.Set("raw", raw)
+	db.Close()
+
+	db, err = Open(f, &Config{Codec: FlateCodec{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("compressed", raw)
+	type User struct {
+		Name string
+		Tags []string
+	}
+	u := User{Name: "name", Tags: []string{"tag", "tag", "tag"}}
+	db.Set("user", u)
+	fi, _ := os.Stat(f)
+	if fi.Size() >= int64(2*len(raw)) {
+		t.Error("value not compressed", fi.Size())
+	}
+	for _, k := range []string{"raw", "compressed"} {
+		var b []byte
+		err = db.Get(k, &b)
+		if err != nil || !bytes.Equal(b, raw) {
+			t.Error("wrong value", k, len(b), err)
+		}
+	}
+	var u2 User
+	err = db.Get("user", &u2)
+	if err != nil || u2.Name != u.Name || len(u2.Tags) != 3 {
+		t.Error("wrong user", u2, err)
+	}
+	db.Close()
+
+	db, _ = Open(f, nil)
+	var b []byte
+	if err = db.Get("compressed", &b); err != ErrNoCodec {
+		t.Error("must require codec", err)
+	}
+	db.DeleteFile()
+}
+
+type testKeyProvider []byte
+
+func (p testKeyProvider) Key() ([]byte, error) {
+	return p, nil
+}
+
+func TestEncryption(t *testing.T) {
+	f := "test/encryption"
+	key := bytes.Repeat([]byte{1}, 32)
+	wrongKey := bytes.Repeat([]byte{2}, 32)
+	for _, encryptKeys := range []bool{false, true} {
+		DeleteFile(f)
+		cfg := &Config{KeyProvider: testKeyProvider(key), EncryptKeys: encryptKeys}
+		db, err := Open(f, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 3; i > 0; i-- {
+			db.Set(fmt.Sprintf("secret%d", i), fmt.Sprintf("pii%d", i))
+		}
+		db.Delete("secret3")
+		// backup encrypted with key of db
+		BackupAll("test/backupenc")
+		db.Close()
+
+		for _, name := range []string{f, "test/backupenc/" + f} {
+			b, _ := ioutil.ReadFile(name)
+			if bytes.Contains(b, []byte("pii")) {
+				t.Error("plaintext value in file", name)
+			}
+			b, _ = ioutil.ReadFile(name + ".idx")
+			if bytes.Contains(b, []byte("secret")) != !encryptKeys {
+				t.Error("key encryption", name, encryptKeys)
+			}
+		}
+		backup, err := Open("test/backupenc/"+f, &Config{EncryptionKey: key, EncryptKeys: encryptKeys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bv string
+		if err = backup.Get("secret1", &bv); err != nil || bv != "pii1" {
+			t.Error("backup value", bv, err)
+		}
+		backup.DeleteFile()
+		var b []byte
+
+		db, err = Open(f, &Config{EncryptionKey: key, EncryptKeys: encryptKeys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, _ := db.Keys(nil, 0, 0, true)
+		if len(keys) != 2 || string(keys[0]) != "secret1" {
+			t.Error("wrong keys", len(keys))
+		}
+		var v string
+		err = db.Get("secret2", &v)
+		if err != nil || v != "pii2" {
+			t.Error("wrong value", v, err)
+		}
+		// value of other key rejected
+		cmd, _ := db.index.get([]byte("secret1"))
+		_, err = db.loadValue([]byte("secret2"), cmd)
+		if err != ErrEncryption {
+			t.Error("value bound to other key", err)
+		}
+		// value encrypted without key by previous versions
+		c, _ := db.seal([]byte("pii"), nil)
+		b, err = db.decodeVal([]byte("secret1"), c, flagEncrypted)
+		if err != nil || string(b) != "pii" {
+			t.Error("legacy value", string(b), err)
+		}
+		db.Close()
+
+		for _, cfg := range []*Config{{EncryptionKey: wrongKey}, nil} {
+			_, err = Open(f, cfg)
+			if err != ErrEncryption {
+				t.Error("must fail with wrong key", err)
+			}
+		}
+	}
+	DeleteFile(f)
+}
+
+func TestSkiplist(t *testing.T) {
+	s := newSkiplist()
+	ref := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		k := []byte(strconv.Itoa(rand.Intn(1000)))
+		if rand.Intn(3) == 0 {
+			if s.remove(k) != ref[string(k)] {
+				t.Fatal("remove", string(k))
+			}
+			delete(ref, string(k))
+		} else {
+			if s.insert(k) == ref[string(k)] {
+				t.Fatal("insert", string(k))
+			}
+			ref[string(k)] = true
+		}
+	}
+	sorted := make([]string, 0, len(ref))
+	for k := range ref {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	if s.length != len(sorted) {
+		t.Fatal("length", s.length, len(sorted))
+	}
+	i := 0
+	for n := s.first(); n != nil; n = n.step(true) {
+		if string(n.key) != sorted[i] {
+			t.Fatal("asc order", string(n.key), sorted[i])
+		}
+		i++
+	}
+	for n := s.last(); n != nil; n = n.step(false) {
+		i--
+		if string(n.key) != sorted[i] {
+			t.Fatal("desc order", string(n.key), sorted[i])
+		}
+	}
+	n := s.seek([]byte("5"))
+	j := sort.SearchStrings(sorted, "5")
+	if (n == nil) != (j == len(sorted)) || (n != nil && string(n.key) != sorted[j]) {
+		t.Error("seek")
+	}
+}
+
+// run go test -bench=SetKeys -benchmem
+func BenchmarkSetKeys(b *testing.B) {
+	f := "test/setkeys"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 100000; i++ {
+		db.Set(rand.Int(), 1)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.Set(rand.Int(), 1)
+		db.Keys(nil, 10, 0, true)
+	}
+	b.StopTimer()
+	db.DeleteFile()
+}
+
+// run with -race
+func TestConcurrentReadWrite(t *testing.T) {
+	f := "test/readwrite"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				key := fmt.Sprintf("%d:%03d", w, rand.Intn(100))
+				if i%3 == 0 {
+					db.Delete(key)
+				} else {
+					db.Set(key, i)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				db.Keys(nil, 10, r, r%2 == 0)
+				db.Keys([]byte("1:*"), 0, 0, r%2 == 0)
+				db.KeysByPrefix([]byte("2:0"), 5, 0, false)
+				db.Has("3:050")
+				db.Count()
+				var v int
+				db.Get("0:010", &v)
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	// concurrent open return same Db
+	db.Close()
+	opened := make(chan *Db, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			db, _ := Open(f, nil)
+			opened <- db
+		}()
+	}
+	first := <-opened
+	for i := 1; i < 10; i++ {
+		if <-opened != first {
+			t.Error("db opened twice")
+		}
+	}
+	first.DeleteFile()
+}
+
+func TestKeySize(t *testing.T) {
+	f := "test/keysize"
+	DeleteFile(f)
+	os.MkdirAll("test", 0755)
+	// version 4 file: 2byte key size
+	val, _ := ValToBinary(42)
+	fk, _ := os.Create(f + ".idx")
+	_, err := writeKey(fk, formatV4, 0, &Cmd{Size: uint64(len(val)), Checksum: crc32.Checksum(val, crcTable)}, []byte("key"), -1)
+	fk.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(f, val, 0644)
+
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	max := bytes.Repeat([]byte("k"), math.MaxUint16)
+	long := bytes.Repeat([]byte("l"), math.MaxUint16+1)
+	if err = db.Set(max, 1); err != nil {
+		t.Error("max key", err)
+	}
+	var tooLong *ErrKeyTooLong
+	err = db.Set(long, 2)
+	if !errors.As(err, &tooLong) || tooLong.Size != len(long) || tooLong.Max != math.MaxUint16 {
+		t.Error("legacy long key must fail", err)
+	}
+	if has, _ := db.Has(long); has {
+		t.Error("rejected key stored")
+	}
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set(long, 2); err != nil {
+		t.Error("long key after upgrade", err)
+	}
+	huge := bytes.Repeat([]byte("h"), 1<<20)
+	if err = db.Set(huge, 3); err != nil {
+		t.Error("huge key", err)
+	}
+	db.Close()
+
+	db, err = Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	for i, k := range [][]byte{[]byte("key"), max, long, huge} {
+		v = 0
+		if err = db.Get(k, &v); err != nil || v != []int{42, 1, 2, 3}[i] {
+			t.Error("get", len(k), v, err)
+		}
+	}
+	if cnt, _ := db.Count(); cnt != 4 {
+		t.Error("count", cnt)
+	}
+	db.Delete(long)
+	db.Close()
+	db, _ = Open(f, nil)
+	if has, _ := db.Has(long); has {
+		t.Error("deleted long key")
+	}
+	db.DeleteFile()
+
+	// varint size boundaries
+	for _, n := range []int{0, 127, 128, 16383, 16384, math.MaxUint16, math.MaxUint16 + 1} {
+		key := bytes.Repeat([]byte("a"), n)
+		b, err := encodeRecord(currentFormat, 0, &Cmd{}, key)
+		if err != nil || int64(len(b)) != recordSize(currentFormat, key) {
+			t.Error("record size", n, len(b), err)
+		}
+		rec, size, err := decodeRecord(b)
+		if err != nil || size != len(b) || !bytes.Equal(rec.key, key) {
+			t.Error("decode", n, size, err)
+		}
+		if _, _, err = decodeRecord(b[:len(b)-1]); err != errShortRecord {
+			t.Error("short", n, err)
+		}
+	}
+}
+
+func TestPackedIndex(t *testing.T) {
+	m := newIndex(IndexMap, 0)
+	p := newIndex(IndexPacked, 0)
+	key := func() []byte {
+		k := fmt.Sprintf("%05d", rand.Intn(5000))
+		switch rand.Intn(100) {
+		case 0:
+			return append([]byte(k), bytes.Repeat([]byte("b"), chunkSize/8)...)
+		case 1:
+			return nil
+		}
+		return append([]byte(k), bytes.Repeat([]byte("s"), 200)...)
+	}
+	check := func() {
+		if m.len() != p.len() {
+			t.Fatal("len", m.len(), p.len())
+		}
+		// nil from walks all keys in both directions
+		from := key()
+		for from == nil {
+			from = key()
+		}
+		var mk, pk [][]byte
+		m.ascend(from, func(k []byte, cmd *Cmd) bool { mk = append(mk, k); return true })
+		p.ascend(from, func(k []byte, cmd *Cmd) bool { pk = append(pk, k); return true })
+		m.descend(from, func(k []byte, cmd *Cmd) bool { mk = append(mk, k); return true })
+		p.descend(from, func(k []byte, cmd *Cmd) bool { pk = append(pk, k); return true })
+		if len(mk) != m.len() || len(pk) != len(mk) {
+			t.Fatal("walk", len(mk), len(pk))
+		}
+		for i := range mk {
+			if !bytes.Equal(mk[i], pk[i]) {
+				t.Fatal("order", i)
+			}
+			mc, _ := m.get(mk[i])
+			pc, ok := p.get(pk[i])
+			if !ok || mc.Seek != pc.Seek || mc.Size != pc.Size || mc.KeySeek != pc.KeySeek || mc.Expire != pc.Expire || mc.Flags != pc.Flags {
+				t.Fatal("record", i, mc, pc)
+			}
+		}
+	}
+	for i := 0; i < 30000; i++ {
+		k := key()
+		if rand.Intn(3) == 0 {
+			m.remove(k)
+			p.remove(k)
+		} else {
+			cmd := Cmd{Seek: rand.Uint64(), Size: uint64(i), KeySeek: uint64(i), Expire: uint32(i), Flags: uint8(i)}
+			m.put(k, &Cmd{Seek: cmd.Seek, Size: cmd.Size, KeySeek: cmd.KeySeek, Expire: cmd.Expire, Flags: cmd.Flags})
+			p.put(k, &cmd)
+		}
+		if i%5000 == 0 {
+			check()
+		}
+	}
+	check()
+	for m.len() > 10 {
+		m.ascend(nil, func(k []byte, cmd *Cmd) bool {
+			m.remove(k)
+			p.remove(k)
+			return false
+		})
+	}
+	check()
+	if ar := p.(*packedIndex).arena; ar.dead != 0 && ar.dead > ar.live+chunkSize {
+		t.Error("arena not rebuilt", ar.live, ar.dead)
+	}
+
+	// db with packed index
+	f := "test/packed"
+	DeleteFile(f)
+	cfg := *DefaultConfig
+	cfg.IndexMode = IndexPacked
+	db, err := Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		db.Set(i, i)
+	}
+	db.Delete(10)
+	db.Close()
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if err = db.Get(999, &v); err != nil || v != 999 {
+		t.Error("get", v, err)
+	}
+	keys, _ := db.Keys(9, 2, 0, true)
+	if cnt, _ := db.Count(); cnt != 999 || len(keys) != 2 || !bytes.Equal(keys[0], mustKey(11)) {
+		t.Error("keys", cnt, keys)
+	}
+	db.DeleteFile()
+}
+
+func mustKey(k interface{}) []byte {
+	b, _ := KeyToBinary(k)
+	return b
+}
+
+// BenchmarkIndexMemory report heap bytes per key of index modes, 16 byte keys
+// packed index target - under 100 B/key
+func BenchmarkIndexMemory(b *testing.B) {
+	const n = 1 << 18
+	for _, mode := range []int{IndexMap, IndexPacked} {
+		b.Run(fmt.Sprintf("mode%d", mode), func(b *testing.B) {
+			var ms runtime.MemStats
+			var perKey float64
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				before := ms.HeapAlloc
+				ix := newIndex(mode, 0)
+				for j := 0; j < n; j++ {
+					ix.put([]byte(fmt.Sprintf("%016d", rand.Int63())), &Cmd{Seek: uint64(j), Size: 1})
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				perKey = float64(ms.HeapAlloc-before) / n
+				runtime.KeepAlive(ix)
+			}
+			b.ReportMetric(perKey, "B/key")
+			if mode == IndexPacked && perKey > 100 {
+				b.Error("packed index memory", perKey)
+			}
+		})
+	}
+}
+
+func TestDiskIndex(t *testing.T) {
+	f := "test/diskindex"
+	DeleteFile(f)
+	cfg := *DefaultConfig
+	cfg.IndexMode = IndexDisk
+	cfg.MemtableKeys = 100
+	db, err := Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := make(map[int]int)
+	for i := 0; i < 5000; i++ {
+		k := rand.Intn(2000)
+		if rand.Intn(4) == 0 {
+			db.Delete(k)
+			delete(model, k)
+		} else {
+			db.Set(k, i)
+			model[k] = i
+		}
+	}
+	check := func(db *Db) {
+		t.Helper()
+		if cnt, _ := db.Count(); cnt != len(model) {
+			t.Fatal("count", cnt, len(model))
+		}
+		sorted := make([]int, 0, len(model))
+		for k, v := range model {
+			var got int
+			if err := db.Get(k, &got); err != nil || got != v {
+				t.Fatal("get", k, got, v, err)
+			}
+			sorted = append(sorted, k)
+		}
+		sort.Ints(sorted)
+		keys, err := db.Keys(nil, 0, 0, true)
+		if err != nil || len(keys) != len(sorted) {
+			t.Fatal("keys", len(keys), err)
+		}
+		for i, k := range keys {
+			if !bytes.Equal(k, mustKey(sorted[i])) {
+				t.Fatal("order", i)
+			}
+		}
+		from := sorted[len(sorted)/2]
+		desc, _ := db.Keys(from, 3, 1, false)
+		if len(desc) != 3 || !bytes.Equal(desc[0], mustKey(sorted[len(sorted)/2-2])) {
+			t.Fatal("desc", desc)
+		}
+		if has, _ := db.Has(2001); has {
+			t.Fatal("has")
+		}
+	}
+	check(db)
+	d := db.diskIndex()
+	if len(d.runs) == 0 || len(d.runs) > 8 || d.mem.len() >= 100 {
+		t.Error("runs", len(d.runs), d.mem.len())
+	}
+	db.Close()
+
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	// copy runs, matched with index log before compaction
+	runs, _ := listRuns(f)
+	old := make(map[string][]byte)
+	for _, rf := range runs {
+		old[rf.file], _ = ioutil.ReadFile(rf.file)
+	}
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.diskIndex().runs) != 1 {
+		t.Error("runs after compact", len(db.diskIndex().runs))
+	}
+	check(db)
+	// writers during compaction, memtable flushed to runs
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			k := rand.Intn(2000)
+			if i%4 == 0 {
+				db.Delete(k)
+			} else {
+				db.Set(k, -i)
+			}
+		}
+		close(done)
+	}()
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	model = make(map[int]int)
+	for k := 0; k < 2000; k++ {
+		var v int
+		if db.Get(k, &v) == nil {
+			model[k] = v
+		}
+	}
+	check(db)
+	db.Close()
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	db.Close()
+
+	// stale runs must be ignored
+	removeRuns(f)
+	for file, b := range old {
+		ioutil.WriteFile(file, b, 0644)
+	}
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	db.DeleteFile()
+	if runs, _ = listRuns(f); len(runs) != 0 {
+		t.Error("runs not deleted", runs)
+	}
+
+	cfg.EncryptionKey = bytes.Repeat([]byte("k"), 16)
+	cfg.EncryptKeys = true
+	if _, err = Open(f, &cfg); err != ErrIndexMode {
+		t.Error("encrypted keys", err)
+	}
+	DeleteFile(f)
+}
+
+func TestCheckpoint(t *testing.T) {
+	f := "test/checkpoint"
+	f2 := "test/checkpoint2"
+	DeleteFile(f)
+	DeleteFile(f2)
+	cfg := *DefaultConfig
+	cfg.Checkpoint = true
+	db, err := Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := make(map[int]int)
+	write := func(db *Db, n int) {
+		for i := 0; i < n; i++ {
+			k := rand.Intn(300)
+			if rand.Intn(4) == 0 {
+				db.Delete(k)
+				delete(model, k)
+			} else {
+				db.Set(k, i)
+				model[k] = i
+			}
+		}
+	}
+	check := func(db *Db) {
+		t.Helper()
+		if cnt, _ := db.Count(); cnt != len(model) {
+			t.Fatal("count", cnt, len(model))
+		}
+		for k, v := range model {
+			var got int
+			if err := db.Get(k, &got); err != nil || got != v {
+				t.Fatal("get", k, got, v, err)
+			}
+		}
+	}
+	write(db, 1000)
+	db.Close()
+	if _, err = os.Stat(f + checkpointSuffix); err != nil {
+		t.Fatal("no checkpoint", err)
+	}
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+
+	// crash after checkpoint: copy files without Close
+	write(db, 500)
+	db.Sync()
+	for _, ext := range []string{"", ".idx", checkpointSuffix} {
+		b, _ := ioutil.ReadFile(f + ext)
+		ioutil.WriteFile(f2+ext, b, 0644)
+	}
+	// records before checkpoint are not read
+	fk, _ := os.OpenFile(f2+".idx", os.O_RDWR, 0644)
+	fk.WriteAt(make([]byte, 20), 1)
+	fk.Close()
+	db2, err := Open(f2, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db2)
+	db2.DeleteFile()
+
+	// damaged checkpoint ignored
+	db.Close()
+	b, _ := ioutil.ReadFile(f + checkpointSuffix)
+	b[len(b)/2]++
+	ioutil.WriteFile(f+checkpointSuffix, b, 0644)
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	db.Close()
+
+	// without checkpoint records updated in place, checkpoint removed
+	cfg.Checkpoint = false
+	db, _ = Open(f, &cfg)
+	if _, err = os.Stat(f + checkpointSuffix); !os.IsNotExist(err) {
+		t.Error("stale checkpoint", err)
+	}
+	write(db, 500)
+	db.Close()
+	cfg.Checkpoint = true
+	db, _ = Open(f, &cfg)
+	check(db)
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	write(db, 200)
+	if err = db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, _ = Open(f, &cfg)
+	check(db)
+	db.DeleteFile()
+	if _, err = os.Stat(f + checkpointSuffix); !os.IsNotExist(err) {
+		t.Error("checkpoint not deleted", err)
+	}
+
+	// keys of checkpoint encrypted
+	cfg.EncryptionKey = bytes.Repeat([]byte("k"), 16)
+	cfg.EncryptKeys = true
+	db, _ = Open(f, &cfg)
+	for i := 0; i < 10; i++ {
+		db.Set(fmt.Sprintf("secret%d", i), i)
+	}
+	db.Close()
+	b, _ = ioutil.ReadFile(f + checkpointSuffix)
+	if len(b) == 0 || bytes.Contains(b, []byte("secret")) {
+		t.Error("plaintext key in checkpoint", len(b))
+	}
+	db, _ = Open(f, &cfg)
+	keys, _ := db.Keys(nil, 0, 0, true)
+	if len(keys) != 10 || string(keys[0]) != "secret0" {
+		t.Error("keys of encrypted checkpoint", len(keys))
+	}
+	db.DeleteFile()
+}
+
+func TestBloom(t *testing.T) {
+	f := "test/bloom"
+	DeleteFile(f)
+	cfg := *DefaultConfig
+	cfg.IndexMode = IndexDisk
+	cfg.MemtableKeys = 100
+	cfg.BloomFalsePositive = 0.01
+	db, err := Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err = db.Set(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2000; i += 10 {
+		db.Delete(i)
+	}
+	check := func(db *Db) {
+		t.Helper()
+		before := db.BloomStats()
+		for i := 0; i < 2000; i++ {
+			has, _ := db.Has(i)
+			if has != (i%10 != 0) {
+				t.Fatal("has", i, has)
+			}
+		}
+		for i := 2000; i < 4000; i++ {
+			if has, _ := db.Has(i); has {
+				t.Fatal("missing key found", i)
+			}
+		}
+		st := db.BloomStats()
+		if st.Lookups-before.Lookups < 2000 || st.Negatives-before.Negatives < 1900 {
+			t.Error("stats", before, st)
+		}
+	}
+	check(db)
+	db.Close()
+
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range db.diskIndex().runs {
+		if r.bloom == nil {
+			t.Fatal("filter not loaded")
+		}
+	}
+	check(db)
+	db.Close()
+
+	// filters are optional
+	cfg.BloomFalsePositive = 0
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := db.Has(2001); has || db.BloomStats() != (BloomStats{}) {
+		t.Error("no filters", db.BloomStats())
+	}
+	if cnt, _ := db.Count(); cnt != 1800 {
+		t.Error("count", cnt)
+	}
+	db.Close()
+	DeleteFile(f)
+}
+
+func TestCache(t *testing.T) {
+	f := "test/cache"
+	DeleteFile(f)
+	cfg := *DefaultConfig
+	cfg.CacheSize = 10 * (cacheEntry + 100)
+	db, err := Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteFile(f)
+	for i := 0; i < 20; i++ {
+		db.Set(i, bytes.Repeat([]byte{byte(i)}, 90))
+	}
+	var b []byte
+	for n := 0; n < 3; n++ {
+		if err = db.Get(1, &b); err != nil || len(b) != 90 || b[0] != 1 {
+			t.Fatal("get", b, err)
+		}
+	}
+	if st := db.CacheStats(); st.Hits != 2 || st.Misses != 1 || st.Items != 1 {
+		t.Error("stats", st)
+	}
+	// cached value is copied
+	b[0] = 42
+	db.Get(1, &b)
+	if b[0] != 1 {
+		t.Error("cached value modified")
+	}
+	db.Set(1, "new")
+	var s string
+	if err = db.Get(1, &s); err != nil || s != "new" {
+		t.Error("set not invalidated", s, err)
+	}
+	db.Delete(1)
+	if err = db.Get(1, &s); err != ErrKeyNotFound {
+		t.Error("delete not invalidated", err)
+	}
+	// size is bounded, least recently used evicted
+	for i := 2; i < 20; i++ {
+		db.Get(i, &b)
+	}
+	st := db.CacheStats()
+	if st.Size > cfg.CacheSize || st.Items == 0 || st.Items > 10 {
+		t.Error("size", st)
+	}
+	if db.cache.items[string(mustKey(2))] != nil || db.cache.items[string(mustKey(19))] == nil {
+		t.Error("lru order")
+	}
+}
+
+func TestMmap(t *testing.T) {
+	f := "test/mmap"
+	DeleteFile(f)
+	cfg := *DefaultConfig
+	cfg.Mmap = true
+	db, err := Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteFile(f)
+	val := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 1000+i)
+	}
+	check := func() {
+		t.Helper()
+		for i := 0; i < 3000; i += 7 {
+			var b []byte
+			if err := db.Get(i, &b); err != nil || !bytes.Equal(b, val(i)) {
+				t.Fatal("get", i, err)
+			}
+			err := db.ViewValue(i, func(v []byte) error {
+				if !bytes.Equal(v, val(i)) {
+					t.Fatal("view", i)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// file grows past first mapping
+	for i := 0; i < 3000; i++ {
+		if err = db.Set(i, val(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.mapped) < 3000*1000 {
+		t.Error("mapping not grown", len(db.mapped))
+	}
+	check()
+	// view without copy
+	cmd, _ := db.index.get(mustKey(5))
+	db.ViewValue(5, func(v []byte) error {
+		if &v[0] != &db.mapped[cmd.Seek] {
+			t.Error("value copied")
+		}
+		return nil
+	})
+	errStop := errors.New("stop")
+	if err = db.ViewValue(5, func([]byte) error { return errStop }); err != errStop {
+		t.Error("fn error", err)
+	}
+	if err = db.ViewValue(-1, func([]byte) error { return nil }); err != ErrKeyNotFound {
+		t.Error("not found", err)
+	}
+	// update in place visible in mapping
+	db.Set(7, []byte("x"))
+	db.ViewValue(7, func(v []byte) error {
+		if string(v) != "x" {
+			t.Error("update", v)
+		}
+		return nil
+	})
+	db.Set(7, val(7))
+	for i := 0; i < 3000; i++ {
+		if i%7 != 0 {
+			db.Delete(i)
+		}
+	}
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	db.Close()
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.mapped == nil {
+		t.Error("not mapped on open")
+	}
+	check()
+}
+
+func TestSegments(t *testing.T) {
+	f := "test/segments"
+	DeleteFile(f)
+	os.RemoveAll("test/segbackup")
+	cfg := *DefaultConfig
+	cfg.SegmentSize = 10 << 10
+	db, err := Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := make(map[int][]byte)
+	set := func(i, n int) {
+		t.Helper()
+		v := bytes.Repeat([]byte{byte(i)}, 1000+n)
+		if err := db.Set(i, v); err != nil {
+			t.Fatal(err)
+		}
+		model[i] = v
+	}
+	check := func(db *Db) {
+		t.Helper()
+		if cnt, _ := db.Count(); cnt != len(model) {
+			t.Fatal("count", cnt, len(model))
+		}
+		for k, v := range model {
+			var b []byte
+			if err := db.Get(k, &b); err != nil || !bytes.Equal(b, v) {
+				t.Fatal("get", k, err)
+			}
+		}
+	}
+	for i := 0; i < 200; i++ {
+		set(i, 0)
+	}
+	ids, _ := listSegments(f)
+	if len(ids) < 19 {
+		t.Fatal("segments", len(ids))
+	}
+	for _, id := range ids {
+		if stat, _ := os.Stat(segmentName(f, id)); stat.Size() > cfg.SegmentSize {
+			t.Error("segment size", id, stat.Size())
+		}
+	}
+	check(db)
+
+	// first segments dead after overwrite, removed after sync
+	for i := 0; i < 20; i++ {
+		set(i, 1)
+	}
+	if err = db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := os.Stat(f); stat.Size() != 0 {
+		t.Error("value file not truncated", stat.Size())
+	}
+	if _, err = os.Stat(segmentName(f, 1)); !os.IsNotExist(err) {
+		t.Error("dead segment not removed", err)
+	}
+	check(db)
+
+	if err = db.Backup("test/segbackup"); err != nil {
+		t.Fatal(err)
+	}
+	backup := "test/segbackup/segments"
+
+	// garbage in sealed segments
+	for i := 20; i < 200; i += 3 {
+		db.Delete(i)
+		delete(model, i)
+	}
+	for i := 21; i < 200; i += 3 {
+		set(i, 2)
+	}
+	size, _ := db.FileSize()
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	compacted, _ := db.FileSize()
+	if compacted >= size {
+		t.Error("size", size, compacted)
+	}
+	for id, s := range db.segs {
+		if id != db.seg && s.size != s.live {
+			t.Error("garbage after compact", id, s.size, s.live)
+		}
+	}
+
+	// incremental backup: removed segments dropped, sealed ones not copied again
+	db.Set(5, []byte("x"))
+	model[5] = []byte("x")
+	if err = db.Backup("test/segbackup"); err != nil {
+		t.Fatal(err)
+	}
+	ids, _ = listSegments(backup)
+	for _, id := range ids {
+		if _, ok := db.segs[id]; !ok {
+			t.Error("removed segment in backup", id)
+		}
+	}
+	db.Close()
+
+	for _, name := range []string{f, backup} {
+		db, err = Open(name, &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(db)
+		db.Close()
+	}
+	DeleteFile(backup)
+	os.RemoveAll("test/segbackup")
+
+	// sealed segment kept in backup
+	db, _ = Open(f, &cfg)
+	for i := 0; i < 50; i++ {
+		set(1000+i, 0)
+	}
+	db.Backup("test/segbackup")
+	ids, _ = listSegments(backup)
+	first := segmentName(backup, ids[0])
+	stat, _ := os.Stat(first)
+	mtime := stat.ModTime().Add(-time.Hour)
+	os.Chtimes(first, mtime, mtime)
+	set(2000, 0)
+	db.Backup("test/segbackup")
+	if stat, _ = os.Stat(first); !stat.ModTime().Equal(mtime) {
+		t.Error("sealed segment copied again")
+	}
+	db.Close()
+	db, err = Open(backup, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	db.Close()
+	DeleteFile(backup)
+	os.RemoveAll("test/segbackup")
+	DeleteFile(f)
+}
+
+// failCodec fail to encode value "fail"
+type failCodec struct{}
+
+func (failCodec) Encode(b []byte) ([]byte, error) {
+	if string(b) == "fail" {
+		return nil, errors.New("encode")
+	}
+	return b, nil
+}
+
+func (failCodec) Decode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func TestBatch(t *testing.T) {
+	f := "test/batch"
+	DeleteFile(f)
+	cfg := *DefaultConfig
+	cfg.Codec = failCodec{}
+	db, err := Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Set(i, i)
+	}
+	check := func(db *Db, want map[int]int) {
+		t.Helper()
+		if cnt, _ := db.Count(); cnt != len(want) {
+			t.Fatal("count", cnt, len(want))
+		}
+		for k, v := range want {
+			var got int
+			if err := db.Get(k, &got); err != nil || got != v {
+				t.Fatal("get", k, got, v, err)
+			}
+		}
+	}
+	var b Batch
+	b.Set(1, 100)
+	b.Set(20, 200)
+	b.Delete(2)
+	b.Delete(30)
+	b.Set(2, 300)
+	b.Delete(3)
+	if err = db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]int{0: 0, 1: 100, 2: 300, 4: 4, 5: 5, 6: 6, 7: 7, 8: 8, 9: 9, 20: 200}
+	check(db, want)
+
+	// failed batch not applied
+	b.Reset()
+	b.Set(4, 400)
+	b.Delete(5)
+	b.Set(21, 210)
+	b.Set(6, []byte("fail"))
+	if err = db.Write(&b); err == nil {
+		t.Fatal("error expected")
+	}
+	check(db, want)
+	db.Close()
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db, want)
+
+	// batch without commit marker discarded on open
+	b.Reset()
+	b.Set(4, 400)
+	b.Delete(5)
+	b.Set(22, 220)
+	db.Write(&b)
+	db.Close()
+	stat, _ := os.Stat(f + ".idx")
+	os.Truncate(f+".idx", stat.Size()-recordLen(currentFormat, 0))
+	db, err = Open(f, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db, want)
+	if db.Discarded() == 0 {
+		t.Error("batch not discarded")
+	}
+	db.Close()
+
+	// torn record inside batch
+	db, _ = Open(f, &cfg)
+	db.Write(&b)
+	db.Close()
+	stat, _ = os.Stat(f + ".idx")
+	os.Truncate(f+".idx", stat.Size()-recordLen(currentFormat, 0)-5)
+	db, _ = Open(f, &cfg)
+	check(db, want)
+	db.Write(&b)
+	db.Close()
+	db, _ = Open(f, &cfg)
+	want[4], want[22] = 400, 220
+	delete(want, 5)
+	check(db, want)
+	db.DeleteFile()
+
+	// key stay if tombstone not written
+	db, _ = Open(f, nil)
+	db.Set("a", 1)
+	fk := db.fk
+	db.fk, _ = os.Open(f + ".idx")
+	if err = db.Delete("a"); err == nil {
+		t.Error("delete with read only index")
+	}
+	db.fk.Close()
+	db.fk = fk
+	if has, _ := db.Has("a"); !has {
+		t.Error("key deleted without tombstone")
+	}
+	db.DeleteFile()
+
+	// space of batch records counted like after reopen
+	db, _ = Open(f, nil)
+	for i := 0; i < 10; i++ {
+		b.Reset()
+		b.Set(i, i)
+		db.Write(&b)
+	}
+	used, garbage := db.used, db.garbage
+	db.Close()
+	db, _ = Open(f, nil)
+	if db.used != used || db.garbage != garbage {
+		t.Error("space of batches", used, garbage, db.used, db.garbage)
+	}
+	db.DeleteFile()
+
+	// failed batch keep live values of segments and space accounting
+	f = "test/batchseg"
+	DeleteFile(f)
+	cfg.SegmentSize = 4096
+	db, _ = Open(f, &cfg)
+	db.Set("k", bytes.Repeat([]byte("v"), 3000))
+	used, garbage = db.used, db.garbage
+	b.Reset()
+	b.Set("k", bytes.Repeat([]byte("w"), 3000))
+	b.Set("x", []byte("fail"))
+	if err = db.Write(&b); err == nil {
+		t.Fatal("error expected")
+	}
+	db.Sync()
+	if db.used-db.garbage != used-garbage {
+		t.Error("live space after rollback", db.used-db.garbage, used-garbage)
+	}
+	for i := 0; i < 2; i++ {
+		var v []byte
+		if err = db.Get("k", &v); err != nil || len(v) != 3000 || v[0] != 'v' {
+			t.Fatal("value lost after rollback", len(v), err)
+		}
+		db.Close()
+		db, _ = Open(f, &cfg)
+	}
+	db.DeleteFile()
+}
+
+func TestTx(t *testing.T) {
+	f := "test/tx"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Set(fmt.Sprintf("acc%d", i), 100)
+	}
+	// reads see own writes, keys merged with writes
+	errTest := errors.New("test")
+	err = db.Update(func(tx *Tx) error {
+		tx.Set("acc10", 5)
+		tx.Delete("acc3")
+		var v int
+		if err := tx.Get("acc10", &v); err != nil || v != 5 {
+			t.Error("own write", v, err)
+		}
+		if err := tx.Get("acc3", &v); err != ErrKeyNotFound {
+			t.Error("own delete", err)
+		}
+		keys, _ := tx.Keys("acc*", 0, 0, true)
+		if len(keys) != 10 || string(keys[1]) != "acc1" || string(keys[2]) != "acc10" {
+			t.Error("keys", len(keys))
+		}
+		keys, _ = tx.Keys("acc2", 2, 0, true)
+		if len(keys) != 2 || string(keys[0]) != "acc4" {
+			t.Error("keys from", len(keys))
+		}
+		keys, _ = tx.Keys("acc2", 0, 0, false)
+		if len(keys) != 3 || string(keys[0]) != "acc10" {
+			t.Error("keys desc", len(keys))
+		}
+		return errTest
+	})
+	if err != errTest {
+		t.Fatal(err)
+	}
+	// rolled back
+	if ok, _ := db.Has("acc10"); ok {
+		t.Error("write of failed tx applied")
+	}
+	if ok, _ := db.Has("acc3"); !ok {
+		t.Error("delete of failed tx applied")
+	}
+	var leaked *Tx
+	err = db.View(func(tx *Tx) error {
+		leaked = tx
+		return tx.Set("acc1", 0)
+	})
+	if err != ErrTxReadOnly {
+		t.Error("read only", err)
+	}
+	if leaked.Get("acc1", new(int)) != ErrTxClosed {
+		t.Error("tx used after return")
+	}
+
+	// concurrent transfers keep sum
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				from, to := fmt.Sprintf("acc%d", (w+i)%10), fmt.Sprintf("acc%d", (w+i+3)%10)
+				db.Update(func(tx *Tx) error {
+					var a, b int
+					tx.Get(from, &a)
+					tx.Get(to, &b)
+					if a < 7 {
+						return errTest
+					}
+					tx.Set(from, a-7)
+					return tx.Set(to, b+7)
+				})
+			}
+		}(w)
+	}
+	sum := func() (s int) {
+		db.View(func(tx *Tx) error {
+			keys, _ := tx.Keys(nil, 0, 0, true)
+			for _, k := range keys {
+				var v int
+				tx.Get(k, &v)
+				s += v
+			}
+			return nil
+		})
+		return s
+	}
+	for i := 0; i < 20; i++ {
+		if s := sum(); s != 1000 {
+			t.Fatal("sum", s)
+		}
+	}
+	wg.Wait()
+	db.Close()
+	db, _ = Open(f, nil)
+	if s := sum(); s != 1000 {
+		t.Error("sum after reopen", s)
+	}
+	db.DeleteFile()
+}
+
+func TestSnapshot(t *testing.T) {
+	for _, seg := range []int64{0, 256} {
+		f := "test/snapshot"
+		DeleteFile(f)
+		cfg := *DefaultConfig
+		cfg.CacheSize = 1 << 20
+		cfg.SegmentSize = seg
+		db, err := Open(f, &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val := func(i, gen int) string {
+			return fmt.Sprintf("%d-%d-%020d", i, gen, 0)
+		}
+		for i := 0; i < 20; i++ {
+			db.Set(i, val(i, 0))
+		}
+		var v string
+		db.Get(1, &v) // cached
+		s, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// overwrite, delete and add keys, freed space must not be reused
+		for gen := 1; gen < 5; gen++ {
+			for i := 0; i < 20; i += 2 {
+				db.Set(i, val(i, gen))
+			}
+		}
+		for i := 1; i < 20; i += 4 {
+			db.Delete(i)
+		}
+		db.Set(100, "new")
+		if err = db.Compact(); err != ErrSnapshotOpen {
+			t.Error("compact with snapshot", err)
+		}
+		for i := 0; i < 20; i++ {
+			if err := s.Get(i, &v); err != nil || v != val(i, 0) {
+				t.Fatal("snapshot get", i, v, err)
+			}
+		}
+		if ok, _ := s.Has(100); ok {
+			t.Error("key added after snapshot")
+		}
+		if n, _ := s.Count(); n != 20 {
+			t.Error("count", n)
+		}
+		keys, _ := s.Keys(nil, 0, 0, true)
+		if len(keys) != 20 {
+			t.Error("keys", len(keys))
+		}
+		keys, _ = s.Keys(1, 3, 0, true)
+		if len(keys) != 3 {
+			t.Error("keys from deleted key", len(keys))
+		}
+		if err = db.Get(1, &v); err != ErrKeyNotFound {
+			t.Error("db sees snapshot", err)
+		}
+		if err = db.Get(0, &v); err != nil || v != val(0, 4) {
+			t.Error("db get", v, err)
+		}
+		s.Close()
+		if err = s.Get(0, &v); err != ErrSnapshotClosed {
+			t.Error("closed snapshot", err)
+		}
+		if err = db.Compact(); err != nil {
+			t.Error(err)
+		}
+		if err = db.Get(0, &v); err != nil || v != val(0, 4) {
+			t.Error("get after compact", v, err)
+		}
+		db.DeleteFile()
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	for _, mode := range []int{IndexMap, IndexPacked, IndexDisk} {
+		f := "test/cas"
+		DeleteFile(f)
+		cfg := *DefaultConfig
+		cfg.IndexMode = mode
+		cfg.MemtableKeys = 2
+		db, err := Open(f, &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := db.SetIfNotExists("a", 1); !ok || err != nil {
+			t.Error("set if not exists", ok, err)
+		}
+		if ok, _ := db.SetIfNotExists("a", 2); ok {
+			t.Error("set existing key")
+		}
+		if ok, err := db.CompareAndSwap("a", 2, 3); ok || err != nil {
+			t.Error("swap with wrong old", ok, err)
+		}
+		if ok, err := db.CompareAndSwap("a", 1, 3); !ok || err != nil {
+			t.Error("swap", ok, err)
+		}
+		if _, err := db.CompareAndSwap("b", 1, 3); err != ErrKeyNotFound {
+			t.Error("swap missing key", err)
+		}
+		if v, _ := db.Version("a"); v != 2 {
+			t.Error("version", v)
+		}
+		if ok, _ := db.SetIfVersion("a", 4, 1); ok {
+			t.Error("set with old version")
+		}
+		if ok, err := db.SetIfVersion("a", 4, 2); !ok || err != nil {
+			t.Error("set if version", ok, err)
+		}
+		if ok, err := db.SetIfVersion("b", 1, 0); !ok || err != nil {
+			t.Error("set if version of new key", ok, err)
+		}
+		if ok, _ := db.DeleteIfEquals("b", 2); ok {
+			t.Error("delete with wrong value")
+		}
+		if ok, err := db.DeleteIfEquals("b", 1); !ok || err != nil {
+			t.Error("delete if equals", ok, err)
+		}
+		if _, err := db.Version("b"); err != ErrKeyNotFound {
+			t.Error("version of deleted key", err)
+		}
+		for i := 0; i < 5; i++ {
+			db.Set(i, i)
+		}
+		db.Close()
+		db, _ = Open(f, &cfg)
+		var v int
+		version, err := db.GetWithVersion("a", &v)
+		if err != nil || v != 4 || version != 3 {
+			t.Error("version after reopen", version, v, err)
+		}
+
+		// optimistic increments, n created with version greater than all given
+		db.Set("m", 0)
+		base, _ := db.Version("m")
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 25; {
+					var n int
+					version, err := db.GetWithVersion("n", &n)
+					if err != nil && err != ErrKeyNotFound {
+						t.Error(err)
+						return
+					}
+					if ok, _ := db.SetIfVersion("n", n+1, version); ok {
+						i++
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if version, _ = db.GetWithVersion("n", &v); v != 100 || version != base+100 {
+			t.Error("increments", v, version)
+		}
+		// key created again after delete, reopen and compact get new version
+		db.Delete("n")
+		db.Close()
+		db, _ = Open(f, &cfg)
+		db.Compact()
+		db.Close()
+		db, _ = Open(f, &cfg)
+		db.Set("n", 1)
+		if v, _ := db.Version("n"); v <= version {
+			t.Error("version of key created again", v, version)
+		}
+		db.DeleteFile()
+	}
+
+	// versions not stored in legacy format
+	f := "test/cas"
+	val, _ := ValToBinary(42)
+	fk, _ := os.Create(f + ".idx")
+	writeKey(fk, formatV5, 0, &Cmd{Size: uint64(len(val)), Checksum: crc32.Checksum(val, crcTable)}, []byte("key"), -1)
+	fk.Close()
+	ioutil.WriteFile(f, val, 0644)
+	db, _ := Open(f, nil)
+	if _, err := db.Version("key"); err != ErrFormat {
+		t.Error("legacy version", err)
+	}
+	if ok, _ := db.CompareAndSwap("key", 42, 43); !ok {
+		t.Error("legacy swap")
+	}
+	db.Compact()
+	// keys stored before upgrade have version 0
+	if ok, err := db.SetIfVersion("key", 44, 0); !ok || err != nil {
+		t.Error("version after upgrade", ok, err)
+	}
+	if v, _ := db.Version("key"); v != 1 {
+		t.Error("version after upgrade", v)
+	}
+	db.DeleteFile()
+}
+
+func TestCounters(t *testing.T) {
+	f := "test/counters"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// counter stored with gob
+	db.Set("old", int64(5))
+	if n, err := db.Counter("old", 1); n != 6 || err != nil {
+		t.Error("gob counter", n, err)
+	}
+	// int counter stored with gob converted to float
+	db.Set("oldint", int64(5))
+	if f, err := db.FloatCounter("oldint", 0.5); f != 5.5 || err != nil {
+		t.Error("float of gob int counter", f, err)
+	}
+	db.Counter("c", 10)
+	size, _ := db.FileSize()
+	for i := 0; i < 100; i++ {
+		db.Counter("c", 1)
+	}
+	if n, _ := db.Decrement("c", 5); n != 105 {
+		t.Error("decrement", n)
+	}
+	// index records appended in these modes
+	inPlace := !db.appendIndex() && !db.config.AppendOnly && db.segs == nil
+	if grown, _ := db.FileSize(); inPlace && grown != size {
+		t.Error("counter not updated in place", size, grown)
+	}
+	if n, err := db.GetCounter("missing"); n != 0 || err != nil {
+		t.Error("missing counter", n, err)
+	}
+	if f, _ := db.FloatCounter("f", 0.5); f != 0.5 {
+		t.Error("float", f)
+	}
+	if f, _ := db.FloatCounter("f", 0.25); f != 0.75 {
+		t.Error("float", f)
+	}
+	if _, err := db.Counter("f", 1); err != ErrCounterType {
+		t.Error("int of float counter", err)
+	}
+	if f, _ := db.GetFloatCounter("c"); f != 105 {
+		t.Error("float of int counter", f)
+	}
+	// counters read by Get
+	var n int64
+	if err := db.Get("c", &n); n != 105 || err != nil {
+		t.Error("get of counter", n, err)
+	}
+	var fl float64
+	if err := db.Get("f", &fl); fl != 0.75 || err != nil {
+		t.Error("get of float counter", fl, err)
+	}
+	if err := db.Get("f", &n); err != ErrCounterType {
+		t.Error("get int of float counter", err)
+	}
+	// counters as bytes encoded with gob, like counters of previous versions
+	gobC, _ := ValToBinary(int64(105))
+	if res := Gets(f, []interface{}{"c"}); len(res) != 2 || !bytes.Equal(res[1], gobC) {
+		t.Error("gets of counter", res)
+	}
+	BackupAll("test/backupc")
+	if err := Get("test/backupc/"+f, "c", &n); n != 105 || err != nil {
+		t.Error("get of backup counter", n, err)
+	}
+	if n, err := Counter("test/backupc/"+f, "c", 1); n != 106 || err != nil {
+		t.Error("counter of backup", n, err)
+	}
+	if err := Get("test/backupc/"+f, "f", &fl); fl != 0.75 || err != nil {
+		t.Error("get of backup float counter", fl, err)
+	}
+	DeleteFile("test/backupc/" + f)
+	db.SetWithTTL("ttl", int64(1), time.Hour)
+	db.Counter("ttl", 1)
+	if ttl, _ := db.TTL("ttl"); ttl == 0 {
+		t.Error("ttl of counter lost")
+	}
+	db.ResetCounter("f")
+	db.Close()
+	db, _ = Open(f, nil)
+	if n, _ := db.GetCounter("c"); n != 105 {
+		t.Error("counter after reopen", n)
+	}
+	if f, err := db.GetFloatCounter("f"); f != 0 || err != nil {
+		t.Error("reset float", f, err)
+	}
+
+	// counters of different dbs don't block each other
+	db2, _ := Open(f+"2", nil)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(d *Db) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				d.Counter("n", 1)
+			}
+		}([]*Db{db, db2}[w%2])
+	}
+	wg.Wait()
+	if n, _ := db.GetCounter("n"); n != 200 {
+		t.Error("concurrent", n)
+	}
+	if n, _ := db2.GetCounter("n"); n != 200 {
+		t.Error("concurrent", n)
+	}
+	db.DeleteFile()
+	db2.DeleteFile()
+}
+
+func TestCompactReuse(t *testing.T) {
+	f := "test/compactreuse"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		db.Set(i, make([]byte, 100))
+	}
+	// writer frees space and overwrites values in place while values copied
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			k := n % 200
+			v := bytes.Repeat([]byte{byte(n)}, 50+n%50)
+			if n%2 == 0 {
+				db.Delete(k)
+			}
+			db.Set(k, v)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err = db.Compact(); err != nil {
+			t.Error("compact", i, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	for i := 0; i < 200; i++ {
+		var v []byte
+		if err = db.Get(i, &v); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	db.DeleteFile()
+}
+
+func TestGrowEmptyValue(t *testing.T) {
+	f := "test/growempty"
+	DeleteFile(f)
+	db, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteFile(f)
+	// empty value at end of file, larger value appended at same seek
+	db.Set("a", []byte{})
+	db.Set("a", make([]byte, 100))
+	db.Set("b", []byte("bbbb"))
+	if db.garbage < 0 || len(db.holes) > 1 {
+		t.Error("space accounting", db.garbage, db.holes)
+	}
+	var v []byte
+	if err = db.Get("a", &v); err != nil || len(v) != 100 {
+		t.Error("a must be readable", len(v), err)
+	}
+	db.Close()
+}
+
+func TestOpenConcurrent(t *testing.T) {
+	f := "test/openconcurrent"
+	DeleteFile(f)
+	dbc := make(chan *Db)
+	for i := 0; i < 8; i++ {
+		go func() {
+			db, err := Open(f, nil)
+			if err != nil {
+				t.Error(err)
+			}
+			dbc <- db
+		}()
+	}
+	first := <-dbc
+	for i := 1; i < 8; i++ {
+		if db := <-dbc; db != first {
+			t.Error("file opened twice")
+		}
+	}
+	DeleteFile(f)
+}
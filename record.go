@@ -0,0 +1,261 @@
+package pudge
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"time"
+)
+
+// index record versions
+const (
+	formatV0      = uint8(0) // 4byte seek and size
+	formatV1      = uint8(1) // 8byte seek and size
+	formatV2      = uint8(2) // crc32c of value and record
+	formatV3      = uint8(3) // expiration time
+	formatV4      = uint8(4) // value flags
+	formatV5      = uint8(5) // varint key size
+	formatV6      = uint8(6) // version of value
+	currentFormat = formatV6
+)
+
+// index record types
+const (
+	recSet    = uint8(0)
+	recDelete = uint8(1)
+	recBegin  = uint8(2) // start of batch, size - number of operations
+	recCommit = uint8(3) // end of batch, records after begin applied only with commit
+)
+
+// value flags
+const (
+	flagCompressed   = uint8(1 << iota) // value compressed with Config.Codec
+	flagEncrypted                       // value encrypted with AES-GCM
+	flagKeyEncrypted                    // key in index record encrypted with AES-GCM
+	flagCounter                         // value is 8 byte int64 counter
+	flagFloat                           // value is 8 byte float64 counter
+	flagKeyAD                           // encrypted value authenticated with its key
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errShortRecord = errors.New("short record")
+	errBadRecord   = errors.New("bad record")
+)
+
+// ErrCorrupted - malformed record or checksum mismatch
+// File and Offset point to damaged data, Key is empty if key unknown
+type ErrCorrupted struct {
+	File   string
+	Offset int64
+	Key    []byte
+}
+
+func (e *ErrCorrupted) Error() string {
+	return fmt.Sprintf("Error: corrupted data in %s at offset %d, key %q", e.File, e.Offset, e.Key)
+}
+
+// ErrKeyTooLong - key does not fit in index record of Db format
+// formats before v5 store key size in 2 bytes, Compact upgrade format
+type ErrKeyTooLong struct {
+	Size int
+	Max  int
+}
+
+func (e *ErrKeyTooLong) Error() string {
+	return fmt.Sprintf("Error: key size %d exceeds %d bytes", e.Size, e.Max)
+}
+
+// maxKeySize return max size of key in index record of given format
+func maxKeySize(format uint8) int {
+	if format < formatV5 {
+		return math.MaxUint16
+	}
+	return math.MaxInt32
+}
+
+// record represent decoded index record
+type record struct {
+	format   uint8
+	t        uint8 // recSet, recDelete, recBegin or recCommit
+	flags    uint8
+	seek     uint64
+	size     uint64
+	time     uint32
+	expire   uint32
+	checksum uint32
+	version  uint64
+	key      []byte
+}
+
+// recordSize return size of index record for key
+func recordSize(format uint8, key []byte) int64 {
+	return recordLen(format, len(key))
+}
+
+// recordLen return size of index record for key of size n
+func recordLen(format uint8, n int) int64 {
+	switch format {
+	case formatV0:
+		return int64(16 + n)
+	case formatV1:
+		return int64(24 + n)
+	case formatV2:
+		return int64(32 + n)
+	case formatV3:
+		return int64(36 + n)
+	case formatV4:
+		return int64(37 + n)
+	case formatV5:
+		return int64(35 + uvarintLen(uint64(n)) + n)
+	}
+	return int64(43 + uvarintLen(uint64(n)) + n)
+}
+
+// uvarintLen return size of varint encoded v
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// encodeRecord return index record of given format
+func encodeRecord(format uint8, t uint8, cmd *Cmd, key []byte) ([]byte, error) {
+	if len(key) > maxKeySize(format) {
+		return nil, &ErrKeyTooLong{Size: len(key), Max: maxKeySize(format)}
+	}
+	b := make([]byte, 0, recordSize(format, key))
+	b = append(b, format, t) //1byte version, 1byte command code(0-set,1-delete)
+	if format >= formatV4 {
+		b = append(b, cmd.Flags) //1byte value flags
+	}
+	if format == formatV0 {
+		if cmd.Seek+cmd.Size > math.MaxUint32 {
+			return nil, ErrOverflow
+		}
+		b = appendUint32(b, uint32(cmd.Seek)) //4byte seek
+		b = appendUint32(b, uint32(cmd.Size)) //4byte size
+	} else {
+		b = appendUint64(b, cmd.Seek) //8byte seek
+		b = appendUint64(b, cmd.Size) //8byte size
+	}
+	b = appendUint32(b, uint32(time.Now().Unix())) //4byte timestamp
+	if format >= formatV3 {
+		b = appendUint32(b, cmd.Expire) //4byte expiration time
+	}
+	if format >= formatV2 {
+		b = appendUint32(b, cmd.Checksum) //4byte value crc
+	}
+	if format >= formatV6 {
+		b = appendUint64(b, cmd.Version) //8byte version
+	}
+	if format >= formatV5 {
+		b = appendUvarint(b, uint64(len(key))) //varint key size
+	} else {
+		b = append(b, byte(len(key)>>8), byte(len(key))) //2byte key size
+	}
+	b = append(b, key...) //key
+	if format >= formatV2 {
+		b = appendUint32(b, crc32.Checksum(b, crcTable)) //4byte record crc
+	}
+	return b, nil
+}
+
+// decodeRecord read index record from b and return its size
+// errShortRecord returned if b ends before record end,
+// with size of record if known from header.
+// errBadRecord returned with size of record if checksum mismatch
+func decodeRecord(b []byte) (rec record, n int, err error) {
+	if len(b) < 2 {
+		return rec, 0, errShortRecord
+	}
+	rec.format, rec.t = b[0], b[1]
+	if rec.format > currentFormat || rec.t > recCommit {
+		return rec, 0, errBadRecord
+	}
+	head := int(recordSize(rec.format, nil))
+	if rec.format >= formatV2 {
+		head -= 4 // record crc after key
+	}
+	if rec.format >= formatV5 {
+		head-- // varint key size read below
+	}
+	if len(b) < head {
+		return rec, 0, errShortRecord
+	}
+	n = 2
+	if rec.format >= formatV4 {
+		rec.flags = b[n]
+		n++
+	}
+	if rec.format == formatV0 {
+		rec.seek = uint64(binary.BigEndian.Uint32(b[n:]))
+		rec.size = uint64(binary.BigEndian.Uint32(b[n+4:]))
+		n += 8
+	} else {
+		rec.seek = binary.BigEndian.Uint64(b[n:])
+		rec.size = binary.BigEndian.Uint64(b[n+8:])
+		n += 16
+	}
+	rec.time = binary.BigEndian.Uint32(b[n:])
+	n += 4
+	if rec.format >= formatV3 {
+		rec.expire = binary.BigEndian.Uint32(b[n:])
+		n += 4
+	}
+	if rec.format >= formatV2 {
+		rec.checksum = binary.BigEndian.Uint32(b[n:])
+		n += 4
+	}
+	if rec.format >= formatV6 {
+		rec.version = binary.BigEndian.Uint64(b[n:])
+		n += 8
+	}
+	var sizeKey int
+	if rec.format >= formatV5 {
+		v, l := binary.Uvarint(b[n:])
+		if l == 0 {
+			return rec, 0, errShortRecord
+		}
+		if l < 0 || v > uint64(maxKeySize(rec.format)) {
+			return rec, 0, errBadRecord
+		}
+		sizeKey = int(v)
+		n += l
+	} else {
+		sizeKey = int(binary.BigEndian.Uint16(b[n:]))
+		n += 2
+	}
+	size := int(recordLen(rec.format, sizeKey))
+	if len(b) < size {
+		return rec, size, errShortRecord
+	}
+	rec.key = b[n : n+sizeKey]
+	n += sizeKey
+	if rec.format >= formatV2 {
+		if crc32.Checksum(b[:n], crcTable) != binary.BigEndian.Uint32(b[n:]) {
+			return rec, size, errBadRecord
+		}
+		n += 4
+	}
+	return rec, n, nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
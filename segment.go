@@ -0,0 +1,417 @@
+package pudge
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	segmentPrefix = ".seg" // value segments: name.seg<id>, segment 0 is value file
+	segmentShift  = 40     // seek of value: segment id in high bits, offset in low bits
+	maxSegment    = 1 << segmentShift
+)
+
+// segment - file of segmented value log, only active segment written
+type segment struct {
+	f    *os.File
+	size int64
+	live int64 // bytes of live values
+}
+
+func segmentName(name string, id uint32) string {
+	if id == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s%s%d", name, segmentPrefix, id)
+}
+
+// segmentOf return segment id and offset of value seek
+func segmentOf(seek uint64) (uint32, int64) {
+	return uint32(seek >> segmentShift), int64(seek & (maxSegment - 1))
+}
+
+// listSegments return ids of segment files of db, value file not included
+func listSegments(name string) ([]uint32, error) {
+	infos, err := ioutil.ReadDir(filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	base := filepath.Base(name)
+	for _, fi := range infos {
+		if !strings.HasPrefix(fi.Name(), base+segmentPrefix) {
+			continue
+		}
+		var id uint32
+		_, err := fmt.Sscanf(fi.Name()[len(base+segmentPrefix):], "%d", &id)
+		if err == nil && id > 0 && fi.Name() == filepath.Base(segmentName(name, id)) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// openSegments open segments of value log if Config.SegmentSize set or segments
+// exist, the last one is active and becomes db.fv
+func (db *Db) openSegments() error {
+	if db.storemode == 2 {
+		return nil
+	}
+	ids, err := listSegments(db.name)
+	if err != nil || (db.config.SegmentSize <= 0 && len(ids) == 0) {
+		return err
+	}
+	db.segs = make(map[uint32]*segment)
+	ids = append([]uint32{0}, ids...)
+	for _, id := range ids {
+		f := db.fv
+		if id > 0 {
+			f, err = os.OpenFile(segmentName(db.name, id), os.O_RDWR, os.FileMode(db.config.FileMode))
+		}
+		var stat os.FileInfo
+		if err == nil {
+			stat, err = f.Stat()
+		}
+		if err != nil {
+			if id > 0 && f != nil {
+				f.Close()
+			}
+			db.closeSegments()
+			db.segs = nil
+			return err
+		}
+		db.segs[id] = &segment{f: f, size: stat.Size()}
+	}
+	db.seg = ids[len(ids)-1]
+	db.fv = db.segs[db.seg].f
+	return nil
+}
+
+// closeSegments close files of segments, except db.fv
+func (db *Db) closeSegments() {
+	for _, s := range db.segs {
+		if s.f != db.fv {
+			s.f.Close()
+		}
+	}
+}
+
+// countSegments sum live values of segments and return total size of segments
+func (db *Db) countSegments() (size int64) {
+	db.index.ascend(nil, func(k []byte, cmd *Cmd) bool {
+		id, _ := segmentOf(cmd.Seek)
+		if s, ok := db.segs[id]; ok {
+			s.live += int64(cmd.Size)
+		}
+		return true
+	})
+	for _, s := range db.segs {
+		size += s.size
+	}
+	return size
+}
+
+// trackSegment count value of cmd as live (n = 1) or dead (n = -1)
+func (db *Db) trackSegment(cmd *Cmd, n int64) {
+	if cmd == nil {
+		return
+	}
+	id, _ := segmentOf(cmd.Seek)
+	if s, ok := db.segs[id]; ok {
+		s.live += n * int64(cmd.Size)
+	}
+}
+
+// writeSegment append value to active segment and write index record,
+// new segment started if value not fit in Config.SegmentSize. Caller must hold lock
+func (db *Db) writeSegment(sealed, v []byte, cmd *Cmd, keySeek int64) error {
+	s := db.segs[db.seg]
+	limit := db.config.SegmentSize
+	if limit <= 0 || limit > maxSegment {
+		limit = maxSegment
+	}
+	if s.size > 0 && s.size+int64(len(v)) > limit {
+		// seal active segment, it never written again
+		err := s.f.Sync()
+		if err != nil {
+			return err
+		}
+		id := db.seg + 1
+		f, err := os.OpenFile(segmentName(db.name, id), os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(db.config.FileMode))
+		if err != nil {
+			return err
+		}
+		s = &segment{f: f}
+		db.segs[id], db.seg, db.fv = s, id, f
+	}
+	cmd.Size = uint64(len(v))
+	cmd.Checksum = crc32.Checksum(v, crcTable)
+	_, err := s.f.WriteAt(v, s.size)
+	if err != nil {
+		return err
+	}
+	cmd.Seek = uint64(db.seg)<<segmentShift | uint64(s.size)
+	s.size += int64(len(v))
+	if db.config.AppendOnly {
+		err = s.f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	keySeek, err = writeKey(db.fk, db.format, 0, cmd, sealed, keySeek)
+	cmd.KeySeek = uint64(keySeek)
+	return err
+}
+
+// readStored return stored (encoded) value of key from value file or segment
+func (db *Db) readStored(k []byte, cmd *Cmd) ([]byte, error) {
+	if db.segs == nil {
+		return readVal(db.fv, db.format, cmd, k)
+	}
+	id, off := segmentOf(cmd.Seek)
+	s, ok := db.segs[id]
+	if !ok {
+		return nil, &ErrCorrupted{File: segmentName(db.name, id), Offset: off, Key: k}
+	}
+	c := *cmd
+	c.Seek = uint64(off)
+	return readVal(s.f, db.format, &c, k)
+}
+
+// removeDead remove sealed segments without live values. Files synced first,
+// so live index records never point to removed segment. Value file
+// (segment 0) truncated instead. Segments kept while snapshots open.
+// Caller must hold lock
+func (db *Db) removeDead() error {
+	if len(db.snaps) > 0 {
+		// values of snapshots may be there
+		return nil
+	}
+	var dead []uint32
+	for id, s := range db.segs {
+		if id != db.seg && s.live == 0 && s.size > 0 {
+			dead = append(dead, id)
+		}
+	}
+	if len(dead) == 0 {
+		return nil
+	}
+	err := db.fv.Sync()
+	if err == nil {
+		err = db.fk.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	for _, id := range dead {
+		s := db.segs[id]
+		if id == 0 {
+			err = s.f.Truncate(0)
+		} else {
+			s.f.Close()
+			delete(db.segs, id)
+			err = os.Remove(segmentName(db.name, id))
+		}
+		if err != nil {
+			return err
+		}
+		db.used -= s.size
+		db.garbage -= s.size
+		s.size = 0
+	}
+	return nil
+}
+
+// compactSegments move live values of sealed segments with garbage ratio
+// over Config.CompactRatio to active segment and remove sealed segments.
+// Lock held for one segment at a time. Caller must hold compactMu
+func (db *Db) compactSegments() error {
+	db.Lock()
+	if db.closed {
+		db.Unlock()
+		return nil
+	}
+	victims := make(map[uint32][][]byte)
+	for id, s := range db.segs {
+		if id != db.seg && s.size > s.live && float64(s.size-s.live)/float64(s.size) >= db.config.CompactRatio {
+			victims[id] = nil
+		}
+	}
+	if len(victims) > 0 {
+		db.index.ascend(nil, func(k []byte, cmd *Cmd) bool {
+			id, _ := segmentOf(cmd.Seek)
+			if keys, ok := victims[id]; ok {
+				victims[id] = append(keys, append([]byte(nil), k...))
+			}
+			return true
+		})
+	}
+	db.Unlock()
+	ids := make([]uint32, 0, len(victims))
+	for id := range victims {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		db.Lock()
+		err := db.moveSegment(id, victims[id])
+		db.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveSegment copy live values of keys from segment to active segment
+// and remove it. Caller must hold lock
+func (db *Db) moveSegment(id uint32, keys [][]byte) error {
+	if db.closed {
+		return nil
+	}
+	for _, k := range keys {
+		old, ok := db.index.get(k)
+		if !ok {
+			continue
+		}
+		if seg, _ := segmentOf(old.Seek); seg != id {
+			// changed after scan
+			continue
+		}
+		val, err := db.readStored(k, old)
+		if err != nil {
+			return err
+		}
+		cmd := &Cmd{Expire: old.Expire, Flags: old.Flags, Version: old.Version}
+		sealed, err := db.sealKey(k, cmd)
+		if err != nil {
+			return err
+		}
+		keySeek := int64(-1)
+		if !db.appendIndex() && !db.config.AppendOnly {
+			keySeek = int64(old.KeySeek)
+		}
+		err = db.writeSegment(sealed, val, cmd, keySeek)
+		if err != nil {
+			return err
+		}
+		db.index.put(k, cmd)
+		db.track(k, old, cmd)
+		err = db.flushIndex()
+		if err != nil {
+			return err
+		}
+	}
+	return db.removeDead()
+}
+
+// Backup copy files of db to dir, so dir may be opened as db.
+// Sealed segments of segmented value log (Config.SegmentSize) never change,
+// they copied only if missing in dir, so repeated backup to the same dir
+// copy only new segments, active segment and index. Writers wait while
+// active segment (or value file without segments) and index copied.
+// Return error if any.
+func (db *Db) Backup(dir string) error {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	db.RLock()
+	if db.closed || db.storemode == 2 || db.fv == nil {
+		db.RUnlock()
+		return nil
+	}
+	dst := filepath.Join(dir, filepath.Base(db.name))
+	sealed := make(map[uint32]int64)
+	for id, s := range db.segs {
+		if id != db.seg {
+			sealed[id] = s.size
+		}
+	}
+	db.RUnlock()
+	err := os.MkdirAll(dir, os.FileMode(db.config.DirMode))
+	if err != nil {
+		return err
+	}
+	// sealed segments copied without lock
+	for id, size := range sealed {
+		err = copySegment(segmentName(db.name, id), segmentName(dst, id), size, false, os.FileMode(db.config.FileMode))
+		if err != nil {
+			return err
+		}
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+	if db.closed {
+		return nil
+	}
+	// name of index file may be changed by compaction
+	files := map[string]string{db.name + ".idx": dst + ".idx", segmentName(db.name, db.seg): segmentName(dst, db.seg)}
+	for id := range db.segs {
+		if _, ok := sealed[id]; !ok && id != db.seg {
+			// sealed while copied
+			files[segmentName(db.name, id)] = segmentName(dst, id)
+		}
+	}
+	for src, to := range files {
+		err = copySegment(src, to, -1, true, os.FileMode(db.config.FileMode))
+		if err != nil {
+			return err
+		}
+	}
+	// drop segments removed from db since last backup
+	ids, err := listSegments(dst)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, ok := db.segs[id]; !ok {
+			os.Remove(segmentName(dst, id))
+		}
+	}
+	if _, ok := db.segs[0]; ok && db.seg != 0 && db.segs[0].size == 0 {
+		os.Truncate(dst, 0)
+	}
+	return nil
+}
+
+// copySegment copy src file to dst through temporary file,
+// file of the same size in dst skipped unless force. Removed src skipped unless force
+func copySegment(src, dst string, size int64, force bool, mode os.FileMode) error {
+	if stat, err := os.Stat(dst); err == nil && stat.Size() == size && !force {
+		return nil
+	}
+	in, err := os.Open(src)
+	if os.IsNotExist(err) && !force {
+		// removed dead segment
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(dst+".tmp", dst)
+	}
+	if err != nil {
+		os.Remove(dst + ".tmp")
+	}
+	return err
+}
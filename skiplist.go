@@ -0,0 +1,142 @@
+package pudge
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+const (
+	maxLevel = 32
+	pLevel   = 4 // 1/pLevel chance to promote node to next level
+)
+
+// skiplist keeps keys in binary order
+// insert, remove and seek are O(log n), iteration in both directions
+type skiplist struct {
+	head   *slNode
+	tail   *slNode
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+type slNode struct {
+	key  []byte
+	next []*slNode
+	prev *slNode
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &slNode{next: make([]*slNode, maxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (s *skiplist) randomLevel() int {
+	level := 1
+	for level < maxLevel && s.rnd.Intn(pLevel) == 0 {
+		level++
+	}
+	return level
+}
+
+// findPath fill path with last nodes less than key on every level
+func (s *skiplist) findPath(key []byte, path []*slNode) *slNode {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && bytes.Compare(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+		if path != nil {
+			path[i] = x
+		}
+	}
+	return x
+}
+
+// insert add key, return false if key exists
+func (s *skiplist) insert(key []byte) bool {
+	var path [maxLevel]*slNode
+	x := s.findPath(key, path[:])
+	if x.next[0] != nil && bytes.Equal(x.next[0].key, key) {
+		return false
+	}
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			path[i] = s.head
+		}
+		s.level = level
+	}
+	n := &slNode{key: key, next: make([]*slNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = path[i].next[i]
+		path[i].next[i] = n
+	}
+	if path[0] != s.head {
+		n.prev = path[0]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n
+	} else {
+		s.tail = n
+	}
+	s.length++
+	return true
+}
+
+// remove delete key, return false if key not found
+func (s *skiplist) remove(key []byte) bool {
+	var path [maxLevel]*slNode
+	x := s.findPath(key, path[:]).next[0]
+	if x == nil || !bytes.Equal(x.key, key) {
+		return false
+	}
+	for i := 0; i < len(x.next); i++ {
+		path[i].next[i] = x.next[i]
+	}
+	if x.next[0] != nil {
+		x.next[0].prev = x.prev
+	} else {
+		s.tail = x.prev
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+	return true
+}
+
+// seek return first node with key >= key or nil
+func (s *skiplist) seek(key []byte) *slNode {
+	return s.findPath(key, nil).next[0]
+}
+
+// seekLess return last node with key < key or nil
+func (s *skiplist) seekLess(key []byte) *slNode {
+	x := s.findPath(key, nil)
+	if x == s.head {
+		return nil
+	}
+	return x
+}
+
+// first return node with smallest key or nil
+func (s *skiplist) first() *slNode {
+	return s.head.next[0]
+}
+
+// last return node with biggest key or nil
+func (s *skiplist) last() *slNode {
+	return s.tail
+}
+
+// step return next node in given order
+func (n *slNode) step(asc bool) *slNode {
+	if asc {
+		return n.next[0]
+	}
+	return n.prev
+}
@@ -0,0 +1,183 @@
+package pudge
+
+import "errors"
+
+var (
+	// ErrSnapshotClosed - Snapshot used after Close or Db closed
+	ErrSnapshotClosed = errors.New("Error: snapshot closed")
+	// ErrSnapshotOpen - Compact called while snapshots open
+	ErrSnapshotOpen = errors.New("Error: snapshots open, close them before Compact")
+)
+
+// Snapshot - read-only view of Db as of its creation.
+// Index is copied on write: records of keys changed after creation
+// saved in snapshot, other keys read from Db. While snapshots open
+// space of old values not reused and Compact refused
+type Snapshot struct {
+	db    *Db
+	saved map[string]*Cmd // key - record as of snapshot, nil - key not existed
+}
+
+// Snapshot return read-only view of db as of now, must be released with Close.
+// Snapshot wait for running Compact
+func (db *Db) Snapshot() (*Snapshot, error) {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	db.Lock()
+	defer db.Unlock()
+	if db.closed {
+		return nil, ErrSnapshotClosed
+	}
+	s := &Snapshot{db: db, saved: make(map[string]*Cmd)}
+	if db.snaps == nil {
+		db.snaps = make(map[*Snapshot]struct{})
+	}
+	db.snaps[s] = struct{}{}
+	return s, nil
+}
+
+// preserve save record of key in open snapshots before key changed,
+// old is nil for new key. Caller must hold lock
+func (db *Db) preserve(k []byte, old *Cmd) {
+	if len(db.snaps) == 0 {
+		return
+	}
+	if old != nil {
+		c := *old
+		old = &c
+	}
+	for s := range db.snaps {
+		if _, ok := s.saved[string(k)]; !ok {
+			s.saved[string(k)] = old
+		}
+	}
+}
+
+// Close release snapshot, space of old values reused after last snapshot closed
+func (s *Snapshot) Close() error {
+	db := s.db
+	db.Lock()
+	defer db.Unlock()
+	if s.saved == nil {
+		return nil
+	}
+	s.saved = nil
+	delete(db.snaps, s)
+	if len(db.snaps) > 0 || db.closed {
+		return nil
+	}
+	held := db.held
+	db.held = nil
+	for _, h := range held {
+		db.freeHole(h.seek, h.size)
+	}
+	return db.removeDead()
+}
+
+// lock take read lock of db, return error if snapshot or db closed
+func (s *Snapshot) lock() (*Db, error) {
+	db := s.db
+	db.RLock()
+	if db.closed || s.saved == nil {
+		db.RUnlock()
+		return nil, ErrSnapshotClosed
+	}
+	return db, nil
+}
+
+// record return record of key as of snapshot, changed is true if key changed after creation
+func (s *Snapshot) record(k []byte) (cmd *Cmd, changed bool) {
+	cmd, changed = s.saved[string(k)]
+	if !changed {
+		cmd, _ = s.db.index.get(k)
+	}
+	if cmd != nil && isExpired(cmd) {
+		cmd = nil
+	}
+	return cmd, changed
+}
+
+// Get return value by key as of snapshot
+// Return error if any.
+func (s *Snapshot) Get(key, value interface{}) error {
+	db, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer db.RUnlock()
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return err
+	}
+	cmd, changed := s.record(k)
+	if cmd == nil {
+		if err = db.indexErr(); err != nil {
+			return err
+		}
+		return ErrKeyNotFound
+	}
+	var b []byte
+	if changed {
+		// cache hold current value
+		b, err = db.loadValue(k, cmd)
+	} else {
+		b, err = db.readValue(k, cmd)
+	}
+	if err != nil {
+		return err
+	}
+	return decodeValue(b, cmd.Flags, value)
+}
+
+// Has return true if key existed at snapshot creation.
+// Return error if any.
+func (s *Snapshot) Has(key interface{}) (bool, error) {
+	db, err := s.lock()
+	if err != nil {
+		return false, err
+	}
+	defer db.RUnlock()
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return false, err
+	}
+	cmd, _ := s.record(k)
+	return cmd != nil, db.indexErr()
+}
+
+// Count returns the number of items as of snapshot.
+func (s *Snapshot) Count() (int, error) {
+	db, err := s.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer db.RUnlock()
+	n := db.index.len()
+	for k, cmd := range s.saved {
+		if _, ok := db.index.get([]byte(k)); ok {
+			n--
+		}
+		if cmd != nil {
+			n++
+		}
+	}
+	return n, db.indexErr()
+}
+
+// Keys return keys as of snapshot, arguments like Db.Keys
+func (s *Snapshot) Keys(from interface{}, limit, offset int, asc bool) ([][]byte, error) {
+	k, prefix, err := keysFrom(from)
+	if err != nil {
+		return make([][]byte, 0, 0), err
+	}
+	db, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer db.RUnlock()
+	changed := make(map[string]bool, len(s.saved))
+	for key, cmd := range s.saved {
+		changed[key] = cmd != nil && !isExpired(cmd)
+	}
+	return db.mergeKeys(k, prefix, limit, offset, asc, changed)
+}
@@ -0,0 +1,174 @@
+package pudge
+
+import "errors"
+
+var (
+	// ErrTxReadOnly - Set or Delete called in View
+	ErrTxReadOnly = errors.New("Error: transaction is read only")
+	// ErrTxClosed - Tx used after function of Update or View returned
+	ErrTxClosed = errors.New("Error: transaction closed")
+)
+
+// Tx - transaction of Update or View, valid only inside its function.
+// Writes of Tx buffered and visible to its reads, applied to Db
+// as one batch when function returns nil
+type Tx struct {
+	db       *Db
+	writable bool
+	ops      []batchOp
+	writes   map[string]int // key - last operation of key in ops
+}
+
+// Update run fn in read-write transaction. Transactions of Db
+// run one at a time and other readers and writers wait, so
+// transactions are serializable. Writes of fn applied all or nothing
+// if fn return nil, and discarded if fn return error or panics.
+// Methods of Db must not be called inside fn, use methods of tx.
+// Return error of fn or error of commit
+func (db *Db) Update(fn func(tx *Tx) error) error {
+	tx := &Tx{db: db, writable: true, writes: make(map[string]int)}
+	err := tx.run(fn)
+	if err != nil || len(tx.ops) == 0 {
+		return err
+	}
+	return db.commit()
+}
+
+// View run fn in read-only transaction, fn see consistent state of Db,
+// writers wait until fn returns. Views may run concurrently.
+// Methods of Db must not be called inside fn, use methods of tx.
+// Return error of fn
+func (db *Db) View(fn func(tx *Tx) error) error {
+	tx := &Tx{db: db}
+	return tx.run(fn)
+}
+
+// run call fn under lock and apply writes of tx
+func (tx *Tx) run(fn func(tx *Tx) error) error {
+	db := tx.db
+	if tx.writable {
+		db.Lock()
+		defer db.Unlock()
+	} else {
+		db.RLock()
+		defer db.RUnlock()
+	}
+	defer func() {
+		tx.db = nil
+	}()
+	err := fn(tx)
+	if err != nil || len(tx.ops) == 0 {
+		tx.ops = nil
+		return err
+	}
+	return db.write(tx.ops)
+}
+
+// Get return value by key, written by tx or stored in Db
+// Return error if any.
+func (tx *Tx) Get(key, value interface{}) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return err
+	}
+	if i, ok := tx.writes[string(k)]; ok {
+		if tx.ops[i].del {
+			return ErrKeyNotFound
+		}
+		return decodeValue(append([]byte(nil), tx.ops[i].val...), 0, value)
+	}
+	b, flags, err := tx.db.get(k)
+	if err != nil {
+		return err
+	}
+	return decodeValue(b, flags, value)
+}
+
+// Has return true if key exists.
+// Return error if any.
+func (tx *Tx) Has(key interface{}) (bool, error) {
+	if tx.db == nil {
+		return false, ErrTxClosed
+	}
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return false, err
+	}
+	return tx.has(k), tx.db.indexErr()
+}
+
+func (tx *Tx) has(k []byte) bool {
+	if i, ok := tx.writes[string(k)]; ok {
+		return !tx.ops[i].del
+	}
+	cmd, ok := tx.db.index.get(k)
+	return ok && !isExpired(cmd)
+}
+
+// Set store key value in transaction
+// Return error if key or value can't be converted or tx is read only
+func (tx *Tx) Set(key, value interface{}) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return err
+	}
+	if size := tx.db.keySize(k); size > maxKeySize(tx.db.format) {
+		return &ErrKeyTooLong{Size: size, Max: maxKeySize(tx.db.format)}
+	}
+	v, err := ValToBinary(value)
+	if err != nil {
+		return err
+	}
+	tx.writes[string(k)] = len(tx.ops)
+	tx.ops = append(tx.ops, batchOp{key: k, val: append([]byte(nil), v...)})
+	return nil
+}
+
+// Delete remove key in transaction
+// Returns error if key not found or tx is read only
+func (tx *Tx) Delete(key interface{}) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	k, err := KeyToBinary(key)
+	if err != nil {
+		return err
+	}
+	if !tx.has(k) {
+		if err = tx.db.indexErr(); err != nil {
+			return err
+		}
+		return ErrKeyNotFound
+	}
+	tx.writes[string(k)] = len(tx.ops)
+	tx.ops = append(tx.ops, batchOp{key: k, del: true})
+	return nil
+}
+
+// Keys return keys like Db.Keys, keys written or deleted by tx included or excluded
+func (tx *Tx) Keys(from interface{}, limit, offset int, asc bool) ([][]byte, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+	k, prefix, err := keysFrom(from)
+	if err != nil {
+		return make([][]byte, 0, 0), err
+	}
+	changed := make(map[string]bool, len(tx.writes))
+	for key, i := range tx.writes {
+		changed[key] = !tx.ops[i].del
+	}
+	return tx.db.mergeKeys(k, prefix, limit, offset, asc, changed)
+}